@@ -0,0 +1,126 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func NewCmdBundle() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                   "bundle",
+		Short:                 "Export, verify and import signed airgap bundles",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+	}
+
+	cmd.AddCommand(NewCmdBundleKeygen())
+	cmd.AddCommand(NewCmdBundleExport())
+	cmd.AddCommand(NewCmdBundleSplit())
+	cmd.AddCommand(NewCmdBundleVerify())
+	cmd.AddCommand(NewCmdBundleImport())
+
+	return cmd
+}
+
+func NewCmdBundleKeygen() *cobra.Command {
+	var outDir string
+	cmd := &cobra.Command{
+		Use:                   "keygen",
+		Short:                 "Generate an ed25519 key pair for signing bundles",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return lib.GenerateSigningKey(filepath.Join(outDir, "bundle.key"), filepath.Join(outDir, "bundle.pub"))
+		},
+	}
+	cmd.Flags().StringVar(&outDir, "output-dir", "", "Output directory")
+
+	return cmd
+}
+
+func NewCmdBundleVerify() *cobra.Command {
+	var (
+		bundleDir string
+		publicKey string
+	)
+	cmd := &cobra.Command{
+		Use:                   "verify",
+		Short:                 "Verify bundle signature and blob checksums",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fsys, err := lib.OpenBundle(bundleDir)
+			if err != nil {
+				return err
+			}
+			mf, err := lib.VerifyBundle(fsys, publicKey)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✔ %d images, %d blobs verified\n", len(mf.Images), len(mf.Blobs))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&bundleDir, "bundle-dir", "images", "Bundle directory or volume directory")
+	cmd.Flags().StringVar(&publicKey, "public-key", "", "Path to the ed25519 public key used to verify the bundle manifest")
+	_ = cobra.MarkFlagRequired(cmd.Flags(), "public-key")
+
+	return cmd
+}
+
+func NewCmdBundleSplit() *cobra.Command {
+	var (
+		bundleDir  string
+		volumeDir  string
+		volumeSize string
+	)
+	cmd := &cobra.Command{
+		Use:                   "split",
+		Short:                 "Split a bundle into numbered tar volumes of a maximum size",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return splitBundle(bundleDir, volumeDir, volumeSize)
+		},
+	}
+	cmd.Flags().StringVar(&bundleDir, "bundle-dir", "images", "Bundle directory")
+	cmd.Flags().StringVar(&volumeDir, "volume-dir", "volumes", "Directory to write the volumes and their index to")
+	cmd.Flags().StringVar(&volumeSize, "volume-size", "", "Maximum size of a volume (e.g. 4Gi)")
+	_ = cobra.MarkFlagRequired(cmd.Flags(), "volume-size")
+
+	return cmd
+}
+
+func splitBundle(bundleDir, volumeDir, volumeSize string) error {
+	q, err := resource.ParseQuantity(volumeSize)
+	if err != nil {
+		return fmt.Errorf("invalid --volume-size: %w", err)
+	}
+	index, err := lib.SplitBundle(bundleDir, volumeDir, q.Value())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("split %s into %d volumes in %s\n", bundleDir, len(index.Volumes), volumeDir)
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func NewCmdBundleExport() *cobra.Command {
+	var (
+		files      []string
+		nondistro  bool
+		insecure   bool
+		bundleDir  string
+		signingKey string
+		baseFile   string
+		artifacts  bool
+		volumeDir  string
+		volumeSize string
+	)
+	cmd := &cobra.Command{
+		Use:                   "export",
+		Short:                 "Export images into a signed OCI layout bundle",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if volumeSize != "" {
+				if _, err := resource.ParseQuantity(volumeSize); err != nil {
+					return fmt.Errorf("invalid --volume-size: %w", err)
+				}
+			}
+			images, err := GenerateImageList(files, false)
+			if err != nil {
+				return err
+			}
+			opts := lib.BundleOptions{
+				Insecure:  insecure,
+				Nondistro: nondistro,
+				Artifacts: artifacts,
+			}
+			var base *lib.BundleBase
+			if baseFile != "" {
+				base, err = loadBundleBase(baseFile, opts)
+				if err != nil {
+					return err
+				}
+			}
+			mf, err := lib.ExportBundle(images, bundleDir, signingKey, base, opts)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("exported %d images (%d blobs) to %s\n", len(mf.Images), len(mf.Blobs), bundleDir)
+
+			if volumeSize != "" {
+				return splitBundle(bundleDir, volumeDir, volumeSize)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().BoolVar(&nondistro, "allow-nondistributable-artifacts", nondistro, "Allow pushing non-distributable (foreign) layers")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&bundleDir, "bundle-dir", "images", "Bundle directory, must not exist or be empty")
+	cmd.Flags().StringVar(&signingKey, "key", "", "Path to the ed25519 private key used to sign the bundle manifest")
+	cmd.Flags().BoolVar(&artifacts, "include-artifacts", artifacts, "Include the signatures, attestations and SBOMs attached to the images (OCI referrers and cosign tags)")
+	cmd.Flags().StringVar(&volumeSize, "volume-size", "", "Also split the bundle into tar volumes of this maximum size (e.g. 4Gi)")
+	cmd.Flags().StringVar(&volumeDir, "volume-dir", "volumes", "Directory to write the volumes and their index to")
+	cmd.Flags().StringVar(&baseFile, "base", "", "Previous bundle (directory or bundle.json) or image list to build a delta bundle against")
+
+	return cmd
+}
+
+// loadBundleBase accepts either a previous bundle or the image list of a
+// previous release.
+func loadBundleBase(file string, opts lib.BundleOptions) (*lib.BundleBase, error) {
+	if fi, err := os.Stat(file); err == nil && (fi.IsDir() || filepath.Ext(file) == ".json") {
+		return lib.LoadBundleBase(file)
+	}
+	images, err := LoadImageList(file)
+	if err != nil {
+		return nil, err
+	}
+	return lib.ResolveBundleBase(images, opts)
+}
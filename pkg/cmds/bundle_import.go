@@ -0,0 +1,103 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdBundleImport() *cobra.Command {
+	var (
+		nondistro     bool
+		insecure      bool
+		bundleDir     string
+		publicKey     string
+		allowUnsigned bool
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+		dryRun        bool
+	)
+	cmd := &cobra.Command{
+		Use:                   "import",
+		Short:                 "Verify a bundle and push its images to a registry",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			if publicKey == "" && !allowUnsigned {
+				return errors.New("--public-key is required to import a bundle, use --allow-unsigned to skip signature verification")
+			}
+
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+
+			// nothing is pushed unless every blob matches the manifest
+			fsys, err := lib.OpenBundle(bundleDir)
+			if err != nil {
+				return err
+			}
+			mf, err := lib.VerifyBundle(fsys, publicKey)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				for _, img := range mf.Images {
+					target, err := rw.Target(img.Ref)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%s -> %s\n", img.Ref, target)
+				}
+				return nil
+			}
+			opts := lib.BundleOptions{
+				Insecure:  insecure,
+				Nondistro: nondistro,
+			}
+			if mf.Base != nil {
+				if err := lib.CheckBundleBase(mf.Base, rw, opts); err != nil {
+					return err
+				}
+			}
+			return lib.ImportBundle(fsys, mf, rw, opts)
+		},
+	}
+	cmd.Flags().BoolVar(&nondistro, "allow-nondistributable-artifacts", nondistro, "Allow pushing non-distributable (foreign) layers")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&bundleDir, "bundle-dir", "images", "Bundle directory or volume directory, volumes are read in place")
+	cmd.Flags().StringVar(&publicKey, "public-key", "", "Path to the ed25519 public key used to verify the bundle manifest")
+	cmd.Flags().BoolVar(&allowUnsigned, "allow-unsigned", allowUnsigned, "Import without verifying the bundle signature (checksums are still verified)")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Target registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", dryRun, "Print the source -> target mapping of every image without pushing")
+
+	return cmd
+}
@@ -0,0 +1,84 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+)
+
+func TestBundleImportUnsigned(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := layout.Write(dir, empty.Index); err != nil {
+		t.Fatal(err)
+	}
+	mf := lib.BundleManifest{Version: lib.BundleFormatVersion, Created: time.Now().UTC()}
+	if err := lib.WriteBundleManifest(dir, &mf, ""); err != nil {
+		t.Fatal(err)
+	}
+	keyDir := t.TempDir()
+	pub := filepath.Join(keyDir, "bundle.pub")
+	if err := lib.GenerateSigningKey(filepath.Join(keyDir, "bundle.key"), pub); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "without a public key",
+			wantErr: "--public-key is required",
+		},
+		{
+			name:    "with a public key",
+			args:    []string{"--public-key", pub},
+			wantErr: "bundle is not signed",
+		},
+		{
+			name: "with --allow-unsigned",
+			args: []string{"--allow-unsigned"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := NewCmdBundleImport()
+			cmd.SetArgs(append([]string{"--registry", "registry.example.com", "--bundle-dir", dir, "--dry-run"}, tt.args...))
+			cmd.SetOut(io.Discard)
+			cmd.SetErr(io.Discard)
+			err := cmd.Execute()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
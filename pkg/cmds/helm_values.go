@@ -0,0 +1,188 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"kmodules.xyz/go-containerregistry/name"
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+const airgapValuesFile = "values-airgap.yaml"
+
+func NewCmdGenerateHelmValues() *cobra.Command {
+	var (
+		rootDir       string
+		charts        []string
+		outDir        string
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+	)
+	cmd := &cobra.Command{
+		Use:   "generate-helm-values",
+		Short: "Generate values-airgap.yaml for charts so that they use images from the mirror registry",
+		Long: `Generate values-airgap.yaml for charts so that they use images from the mirror registry.
+
+Each chart is rendered with helm template, the values producing its images
+are looked up in the chart values and overridden with the mirrored names.
+The chart is then rendered again with values-airgap.yaml to verify that
+every image points at the mirror.`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+
+			if len(charts) == 0 {
+				entries, err := os.ReadDir(rootDir)
+				if err != nil {
+					return err
+				}
+				for _, entry := range entries {
+					if entry.IsDir() {
+						charts = append(charts, entry.Name())
+					}
+				}
+			}
+
+			var failed int
+			var data [][]string
+			for _, chart := range charts {
+				rows, err := generateAirgapValues(rootDir, chart, outDir, rw)
+				if err != nil {
+					return fmt.Errorf("%s: %w", chart, err)
+				}
+				for _, row := range rows {
+					if row[2] != "ok" {
+						failed++
+					}
+				}
+				data = append(data, rows...)
+			}
+			renderTable(os.Stdout, []string{"Chart", "Image", "Status"}, data)
+
+			if failed > 0 {
+				return fmt.Errorf("%d images are not rewritten to %s", failed, rw.Registry())
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&rootDir, "root-dir", "", "Root directory")
+	cmd.Flags().StringSliceVar(&charts, "chart", charts, "Charts in the root directory to generate values for (defaults to all)")
+	cmd.Flags().StringVar(&outDir, "output-dir", "", "Output directory, values are written into the chart directories if not set")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	_ = cobra.MarkFlagRequired(cmd.Flags(), "root-dir")
+
+	return cmd
+}
+
+// generateAirgapValues writes the values-airgap.yaml of a chart and returns
+// a Chart/Image/Status row for every image of the chart.
+func generateAirgapValues(rootDir, chart, outDir string, rw *lib.Rewriter) ([][]string, error) {
+	if err := lib.UpdateChartDependencies(rootDir, chart); err != nil {
+		return nil, err
+	}
+	imgmap, err := lib.ChartImages(rootDir, chart, "")
+	if err != nil {
+		return nil, err
+	}
+	images := lib.ListImages(imgmap)
+	if len(images) == 0 {
+		return nil, nil
+	}
+
+	values, err := lib.LoadChartValues(rootDir, chart, "")
+	if err != nil {
+		return nil, err
+	}
+	overrides, unresolved, err := lib.AirgapOverrides(values, images, rw)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := yaml.Marshal(lib.OverridesToValues(overrides))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(rootDir, chart)
+	if outDir != "" {
+		dir = filepath.Join(outDir, chart)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	filename, err := filepath.Abs(filepath.Join(dir, airgapValuesFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return nil, err
+	}
+
+	// render again and compare with the expected targets
+	expected := sets.New[string]()
+	for _, img := range images {
+		target, err := rw.Target(img)
+		if err != nil {
+			return nil, err
+		}
+		expected.Insert(normalizeImage(target))
+	}
+	imgmap, err = lib.ChartImages(rootDir, chart, "", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render with %s: %w", filename, err)
+	}
+
+	missing := sets.New(unresolved...)
+	rows := make([][]string, 0, len(imgmap))
+	for _, img := range lib.ListImages(imgmap) {
+		status := "ok"
+		if missing.Has(img) {
+			status = "no values found"
+		} else if !expected.Has(normalizeImage(img)) {
+			status = "not rewritten"
+		}
+		rows = append(rows, []string{chart, img, status})
+	}
+	return rows, nil
+}
+
+func normalizeImage(img string) string {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return img
+	}
+	return ref.Registry + "/" + ref.Repository + ":" + ref.Tag
+}
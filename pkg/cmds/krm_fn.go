@@ -0,0 +1,246 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// krmResult is a result item of a KRM function ResourceList.
+type krmResult struct {
+	Message     string          `yaml:"message"`
+	Severity    string          `yaml:"severity"`
+	ResourceRef *krmResourceRef `yaml:"resourceRef,omitempty"`
+	Field       *krmField       `yaml:"field,omitempty"`
+}
+
+type krmResourceRef struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Name       string `yaml:"name"`
+	Namespace  string `yaml:"namespace,omitempty"`
+}
+
+type krmField struct {
+	Path          string `yaml:"path"`
+	CurrentValue  string `yaml:"currentValue,omitempty"`
+	ProposedValue string `yaml:"proposedValue,omitempty"`
+}
+
+// krmFunctionConfig is the ConfigMap passed as functionConfig. Its data keys
+// override the flags: registry, pinDigests, insecure and rewriteRules, which
+// holds rewrite rules in the format of --rewrite-config.
+type krmFunctionConfig struct {
+	Data map[string]string `yaml:"data"`
+}
+
+func NewCmdKRMFunction() *cobra.Command {
+	var (
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+		pinDigests    bool
+		insecure      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "krm-fn",
+		Short: "KRM function that rewrites images to the mirror registry and pins them by digest",
+		Long: `KRM function that rewrites images to the mirror registry and pins them by digest.
+
+Reads a ResourceList from stdin and writes it to stdout with the image fields
+of all items rewritten like post-render does. Images that could not be pinned
+are reported as warnings in the results, lookup failures as errors.
+
+The flags can be overridden by a ConfigMap given as functionConfig:
+
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: image-packer
+  data:
+    registry: registry.example.com/mirror
+    pinDigests: "true"
+    rewriteRules: |
+      rules:
+      - type: flatten`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			var doc yaml.Node
+			if err := yaml.Unmarshal(in, &doc); err != nil {
+				return fmt.Errorf("failed to parse ResourceList: %w", err)
+			}
+			if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+				return errors.New("input is not a ResourceList")
+			}
+			root := doc.Content[0]
+
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			if fc := mappingValue(root, "functionConfig"); fc != nil {
+				var c krmFunctionConfig
+				if err := fc.Decode(&c); err != nil {
+					return fmt.Errorf("failed to parse functionConfig: %w", err)
+				}
+				if v, ok := c.Data["registry"]; ok {
+					registry = v
+				}
+				if v, ok := c.Data["pinDigests"]; ok {
+					if pinDigests, err = strconv.ParseBool(v); err != nil {
+						return fmt.Errorf("invalid pinDigests: %w", err)
+					}
+				}
+				if v, ok := c.Data["insecure"]; ok {
+					if insecure, err = strconv.ParseBool(v); err != nil {
+						return fmt.Errorf("invalid insecure: %w", err)
+					}
+				}
+				if v, ok := c.Data["rewriteRules"]; ok {
+					if cfg, err = lib.ParseRewriteConfig([]byte(v)); err != nil {
+						return fmt.Errorf("invalid rewriteRules: %w", err)
+					}
+				}
+			}
+
+			var rw *lib.Rewriter
+			if registry != "" {
+				if rw, err = lib.NewRewriter(registry, cfg); err != nil {
+					return err
+				}
+			}
+			var opts []crane.Option
+			if insecure {
+				opts = append(opts, crane.Insecure)
+			}
+
+			var results []krmResult
+			var failed bool
+			if items := mappingValue(root, "items"); items != nil {
+				for _, item := range items.Content {
+					ref := krmItemRef(item)
+					err := lib.RewriteNodeImages(item, func(path, img string) (string, error) {
+						result, pinned, err := mirrorImage(img, rw, pinDigests, opts)
+						if err != nil {
+							failed = true
+							results = append(results, krmResult{
+								Message:     err.Error(),
+								Severity:    "error",
+								ResourceRef: ref,
+								Field:       &krmField{Path: path, CurrentValue: img},
+							})
+							return img, nil
+						}
+						if pinDigests && !pinned {
+							results = append(results, krmResult{
+								Message:     fmt.Sprintf("image %s not found, keeping its tag", result),
+								Severity:    "warning",
+								ResourceRef: ref,
+								Field:       &krmField{Path: path, CurrentValue: img, ProposedValue: result},
+							})
+						}
+						return result, nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			if len(results) > 0 {
+				var node yaml.Node
+				if err := node.Encode(results); err != nil {
+					return err
+				}
+				setMappingValue(root, "results", &node)
+			}
+			enc := yaml.NewEncoder(os.Stdout)
+			enc.SetIndent(2)
+			if err := enc.Encode(&doc); err != nil {
+				return err
+			}
+			if err := enc.Close(); err != nil {
+				return err
+			}
+			if failed {
+				return errors.New("failed to rewrite some images, see results")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY), images are not moved if empty")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().BoolVar(&pinDigests, "pin-digests", pinDigests, "Replace image tags with digests")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+
+	return cmd
+}
+
+func krmItemRef(item *yaml.Node) *krmResourceRef {
+	ref := &krmResourceRef{}
+	if v := mappingValue(item, "apiVersion"); v != nil {
+		ref.APIVersion = v.Value
+	}
+	if v := mappingValue(item, "kind"); v != nil {
+		ref.Kind = v.Value
+	}
+	if md := mappingValue(item, "metadata"); md != nil {
+		if v := mappingValue(md, "name"); v != nil {
+			ref.Name = v.Value
+		}
+		if v := mappingValue(md, "namespace"); v != nil {
+			ref.Namespace = v.Value
+		}
+	}
+	return ref
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(n *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = value
+			return
+		}
+	}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,427 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"kmodules.xyz/go-containerregistry/name"
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/yaml"
+)
+
+// MarketplaceProfile holds the naming and tagging rules of a marketplace.
+type MarketplaceProfile struct {
+	Name string
+	// Script is the generated script, rendered from <Script>.tmpl.
+	Script string
+	// Config is the default naming, it can be replaced with --config.
+	Config MarketplaceConfig
+	// Flatten pushes every image directly under the marketplace registry
+	// with its base name.
+	Flatten bool
+	// TargetTag is the tag the images are pushed with. If empty, they keep
+	// their source tag.
+	TargetTag string
+	// TagPattern, if set, must match the source tag of every image.
+	TagPattern *regexp.Regexp
+	// Forbidden lists patterns that no image may match.
+	Forbidden []ForbiddenPattern
+	// WriteExtras, if set, writes the files that describe the images to the
+	// marketplace next to the script.
+	WriteExtras func(outdir string, rw *lib.Rewriter, images []ScriptImage) error
+}
+
+type ForbiddenPattern struct {
+	Pattern *regexp.Regexp
+	Reason  string
+}
+
+// MarketplaceConfig is the naming a profile can be configured with.
+type MarketplaceConfig struct {
+	// ImageMap maps a source repository, without registry, to its marketplace name.
+	ImageMap map[string]string `json:"imageMap,omitempty"`
+	// Exclude lists repositories, without registry, that are not synced.
+	// Entries may be path.Match globs.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+var semverTag = regexp.MustCompile(`^v?\d+\.\d+\.\d+([-+][0-9A-Za-z.-]+)?$`)
+
+var marketplaceProfiles = map[string]*MarketplaceProfile{
+	"gcp": {
+		Name:   "gcp",
+		Script: "sync-gcp-mp-images.sh",
+		Config: MarketplaceConfig{
+			ImageMap: map[string]string{
+				"defaultbackend-amd64":               "ingress-nginx-defaultbackend",
+				"fluxcd/helm-controller":             "flux-helm-controller",
+				"fluxcd/kustomize-controller":        "flux-kustomize-controller",
+				"fluxcd/notification-controller":     "flux-notification-controller",
+				"fluxcd/source-controller":           "flux-source-controller",
+				"ingress-nginx/controller":           "ingress-nginx-controller",
+				"ingress-nginx/kube-webhook-certgen": "ingress-nginx-kube-webhook-certgen",
+				"kedacore/http-add-on-interceptor":   "keda-http-add-on-interceptor",
+				"kedacore/http-add-on-operator":      "keda-http-add-on-operator",
+				"kedacore/http-add-on-scaler":        "keda-http-add-on-scaler",
+				"prometheus/node-exporter":           "prometheus-node-exporter",
+				"sig-storage/livenessprobe":          "csi-driver-livenessprobe",
+			},
+			Exclude: []string{
+				"prometheus-operator/prometheus-operator",
+			},
+		},
+		Flatten:     true,
+		TargetTag:   "$TAG",
+		WriteExtras: writeGCPSchemaImages,
+	},
+	// AWS Marketplace repositories are created per product in the ECR
+	// registry of the seller account and do not accept mutable tags.
+	"aws": {
+		Name:       "aws",
+		Script:     "sync-aws-mp-images.sh",
+		Flatten:    true,
+		TagPattern: semverTag,
+		Forbidden: []ForbiddenPattern{
+			{Pattern: regexp.MustCompile(`:latest$`), Reason: "AWS Marketplace rejects the latest tag"},
+		},
+	},
+	// Azure Marketplace container offers are pushed to an ACR registry,
+	// which keeps nested repository paths.
+	"azure": {
+		Name:       "azure",
+		Script:     "sync-azure-mp-images.sh",
+		TagPattern: semverTag,
+		Forbidden: []ForbiddenPattern{
+			{Pattern: regexp.MustCompile(`:latest$`), Reason: "Azure Marketplace rejects the latest tag"},
+		},
+	},
+}
+
+func marketplaceProfileNames() []string {
+	names := make([]string, 0, len(marketplaceProfiles))
+	for n := range marketplaceProfiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewCmdGenerateMarketplaceScript() *cobra.Command {
+	var (
+		files   []string
+		opts    ScriptOptions
+		outDir  string
+		profile string
+	)
+	cmd := &cobra.Command{
+		Use:   "generate-marketplace-script",
+		Short: "Generate a script that syncs the images to a cloud marketplace registry",
+		Long: `Generate a script that syncs the images to a cloud marketplace registry.
+
+The profile (` + strings.Join(marketplaceProfileNames(), ", ") + `) decides how images are named and tagged
+in the marketplace. The image list is checked against the naming, tagging and
+forbidden patterns of the profile before the script is written.
+
+The gcp profile also writes the x-google-marketplace.images section of the
+deployer schema.yaml (` + gcpSchemaImagesFile + `) and the chart values it maps to
+(` + gcpValuesImagesFile + `), so that they always match the names used by the script.`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, ok := marketplaceProfiles[profile]
+			if !ok {
+				return fmt.Errorf("unknown profile %q, supported profiles are %s", profile, strings.Join(marketplaceProfileNames(), ", "))
+			}
+			return GenerateMarketplaceScript(p, files, outDir, opts)
+		},
+	}
+	cmd.Flags().StringVar(&profile, "profile", "", "Marketplace profile ("+strings.Join(marketplaceProfileNames(), ", ")+")")
+	cmd.Flags().StringVar(&opts.MarketplaceConfig, "config", "", "YAML file with the marketplace image names and excluded repositories, replaces the ones of the profile")
+	addMarketplaceFlags(cmd, &files, &opts, &outDir)
+	_ = cobra.MarkFlagRequired(cmd.Flags(), "profile")
+
+	return cmd
+}
+
+func addMarketplaceFlags(cmd *cobra.Command, files *[]string, opts *ScriptOptions, outDir *string) {
+	cmd.Flags().StringSliceVar(files, "src", *files, "List of source files (http url or local file)")
+	cmd.Flags().BoolVar(&opts.Nondistro, "allow-nondistributable-artifacts", opts.Nondistro, "Allow pushing non-distributable (foreign) layers")
+	cmd.Flags().BoolVar(&opts.Insecure, "insecure", opts.Insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&opts.TemplateDir, "template-dir", "", "Directory with templates that replace the embedded script templates")
+	cmd.Flags().StringVar(&opts.RewriteConfig, "rewrite-config", "", "YAML file with rewrite rules applied after the image map of the marketplace config and before the profile flattens the names")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "Print the source -> target mapping of every image without writing the script")
+	cmd.Flags().StringVar(outDir, "output-dir", "", "Output directory")
+}
+
+// LoadMarketplaceConfig reads the marketplace naming from a YAML file. If
+// filename is empty, the naming of the profile is returned.
+func LoadMarketplaceConfig(p *MarketplaceProfile, filename string) (*MarketplaceConfig, error) {
+	if filename == "" {
+		return &p.Config, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg MarketplaceConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse marketplace config %s: %w", filename, err)
+	}
+	for _, glob := range cfg.Exclude {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude %q in %s: %w", glob, filename, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func (c *MarketplaceConfig) excluded(repo string) bool {
+	for _, glob := range c.Exclude {
+		if ok, _ := path.Match(glob, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteConfig applies ImageMap to the source repositories, then the rules
+// of extra, if any, and last flattens them if the profile requires it.
+func (p *MarketplaceProfile) rewriteConfig(c *MarketplaceConfig, extra *lib.RewriteConfig) *lib.RewriteConfig {
+	rules := []lib.RewriteRule{
+		{Type: lib.RewriteStripPrefix, Prefix: "library/"},
+	}
+	if len(c.ImageMap) > 0 {
+		rules = append(rules, lib.RewriteRule{Type: lib.RewriteMap, Map: c.ImageMap})
+	}
+	if extra != nil {
+		rules = append(rules, extra.Rules...)
+	}
+	if p.Flatten {
+		rules = append(rules, lib.RewriteRule{Type: lib.RewriteFlatten})
+	}
+	return &lib.RewriteConfig{Rules: rules}
+}
+
+// validate returns the problems of img under the rules of the profile.
+func (p *MarketplaceProfile) validate(img string, ref *name.Image) []string {
+	var problems []string
+	if p.TagPattern != nil && !p.TagPattern.MatchString(ref.Tag) {
+		problems = append(problems, fmt.Sprintf("%s: tag %q does not match %s", img, ref.Tag, p.TagPattern))
+	}
+	for _, f := range p.Forbidden {
+		if f.Pattern.MatchString(img) {
+			problems = append(problems, fmt.Sprintf("%s: %s", img, f.Reason))
+		}
+	}
+	return problems
+}
+
+func GenerateMarketplaceScript(p *MarketplaceProfile, files []string, outdir string, opts ScriptOptions) error {
+	tpl, err := loadScriptTemplates("crane", opts.TemplateDir)
+	if err != nil {
+		return err
+	}
+	mc, err := LoadMarketplaceConfig(p, opts.MarketplaceConfig)
+	if err != nil {
+		return err
+	}
+	var extra *lib.RewriteConfig
+	if opts.RewriteConfig != "" {
+		extra, err = lib.LoadRewriteConfig(opts.RewriteConfig)
+		if err != nil {
+			return err
+		}
+	}
+	rw, err := lib.NewRewriter("$IMAGE_REGISTRY", p.rewriteConfig(mc, extra))
+	if err != nil {
+		return err
+	}
+
+	images, err := GenerateImageList(files, true)
+	if err != nil {
+		return err
+	}
+
+	data := ScriptData{
+		Tool:    "crane",
+		Options: opts,
+		Images:  make([]ScriptImage, 0, len(images)),
+	}
+	var problems []string
+	for _, img := range images {
+		// crane push images/cluster-ui.tar $IMAGE_REGISTRY/cluster-ui:0.4.16
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			return err
+		}
+		if ref.Tag == "" {
+			return fmt.Errorf("image %s has no tag", img)
+		}
+
+		if mc.excluded(ref.Repository) {
+			continue
+		}
+		problems = append(problems, p.validate(img, ref)...)
+		repo, err := rw.Repository(img)
+		if err != nil {
+			return err
+		}
+		tag := p.TargetTag
+		if tag == "" {
+			tag = ref.Tag
+		}
+
+		data.Images = append(data.Images, ScriptImage{
+			Image:   img,
+			Ref:     ref,
+			Target:  rw.Registry() + "/" + repo + ":" + tag,
+			Options: opts,
+		})
+	}
+	if opts.DryRun {
+		printRewrites(data.Images)
+	}
+	problems = append(problems, targetCollisions(data.Images)...)
+	if len(problems) > 0 {
+		return fmt.Errorf("the images do not meet the rules of the %s marketplace:\n  %s", p.Name, strings.Join(problems, "\n  "))
+	}
+	if opts.DryRun {
+		return nil
+	}
+	if err := renderScript(tpl, p.Script, outdir, data); err != nil {
+		return err
+	}
+	if p.WriteExtras != nil {
+		return p.WriteExtras(outdir, rw, data.Images)
+	}
+	return nil
+}
+
+// targetCollisions reports images from different source repositories that
+// would be pushed to the same target repository.
+func targetCollisions(images []ScriptImage) []string {
+	sources := map[string]sets.Set[string]{}
+	for _, img := range images {
+		target := stripTag(img.Target)
+		if sources[target] == nil {
+			sources[target] = sets.New[string]()
+		}
+		sources[target].Insert(img.Ref.Registry + "/" + img.Ref.Repository)
+	}
+
+	var collisions []string
+	for target, srcs := range sources {
+		if srcs.Len() > 1 {
+			collisions = append(collisions, fmt.Sprintf("%s: %s have the same target, give them different names in the image map of the marketplace config or with --rewrite-config",
+				target, strings.Join(sets.List(srcs), ", ")))
+		}
+	}
+	sort.Strings(collisions)
+	return collisions
+}
+
+const (
+	gcpSchemaImagesFile = "schema-images.yaml"
+	gcpValuesImagesFile = "values-images.yaml"
+)
+
+// writeGCPSchemaImages writes the x-google-marketplace.images section of the
+// deployer schema.yaml and the chart values it fills in. Each image is keyed
+// by its name under $IMAGE_REGISTRY and its registry, repository and tag are
+// passed to the chart as images.<name>.registry, .repository and .tag. The
+// values file holds the same target names as the sync script, with
+// $IMAGE_REGISTRY and $TAG left for the release pipeline to substitute.
+func writeGCPSchemaImages(outdir string, rw *lib.Rewriter, images []ScriptImage) error {
+	schema := map[string]any{}
+	values := map[string]any{}
+	keys := map[string]string{}
+	for _, img := range images {
+		repo := stripTag(img.Target)
+		key := strings.TrimPrefix(repo, rw.Registry()+"/")
+		valueKey := strings.NewReplacer("/", "-", ".", "-").Replace(key)
+		if other, ok := keys[valueKey]; ok && other != key {
+			return fmt.Errorf("images %s and %s have the same values key %s", other, key, valueKey)
+		}
+		keys[valueKey] = key
+		prefix := "images." + valueKey + "."
+		schema[key] = map[string]any{
+			"properties": map[string]any{
+				prefix + "registry":   map[string]string{"type": "REGISTRY"},
+				prefix + "repository": map[string]string{"type": "REPO_WITHOUT_REGISTRY"},
+				prefix + "tag":        map[string]string{"type": "TAG"},
+			},
+		}
+		values[valueKey] = map[string]string{
+			"registry":   rw.Registry(),
+			"repository": key,
+			"tag":        strings.TrimPrefix(img.Target, repo+":"),
+		}
+	}
+
+	files := map[string]any{
+		gcpSchemaImagesFile: map[string]any{"x-google-marketplace": map[string]any{"images": schema}},
+		gcpValuesImagesFile: map[string]any{"images": values},
+	}
+	for filename, obj := range files {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(outdir, filename), data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewCmdGenerateGCPScript is kept for existing pipelines, it is the same as
+// generate-marketplace-script --profile gcp.
+func NewCmdGenerateGCPScript() *cobra.Command {
+	var (
+		files  []string
+		opts   ScriptOptions
+		outDir string
+	)
+	cmd := &cobra.Command{
+		Use:                   "generate-gcp-script",
+		Short:                 "Generate GCP Marketplace image syncer script",
+		Deprecated:            "use generate-marketplace-script --profile gcp",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return GenerateGCPScript(files, outDir, opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.MarketplaceConfig, "gcp-config", "", "YAML file with the GCP Marketplace image names and excluded repositories, replaces the built-in lists")
+	addMarketplaceFlags(cmd, &files, &opts, &outDir)
+
+	return cmd
+}
+
+func GenerateGCPScript(files []string, outdir string, opts ScriptOptions) error {
+	return GenerateMarketplaceScript(marketplaceProfiles["gcp"], files, outdir, opts)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"kmodules.xyz/go-containerregistry/name"
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestMarketplaceRewriteConfig(t *testing.T) {
+	gcp := marketplaceProfiles["gcp"]
+	azure := marketplaceProfiles["azure"]
+	extra := &lib.RewriteConfig{Rules: []lib.RewriteRule{
+		{Type: lib.RewriteAddPrefix, Prefix: "kubedb", Registry: "ghcr.io"},
+	}}
+
+	tests := []struct {
+		name    string
+		profile *MarketplaceProfile
+		config  *MarketplaceConfig
+		extra   *lib.RewriteConfig
+		img     string
+		want    string
+	}{
+		{
+			name:    "flattened",
+			profile: gcp,
+			config:  &gcp.Config,
+			img:     "ghcr.io/appscode/cluster-ui:0.9.7",
+			want:    "$IMAGE_REGISTRY/cluster-ui:0.9.7",
+		},
+		{
+			name:    "image map",
+			profile: gcp,
+			config:  &gcp.Config,
+			img:     "registry.k8s.io/ingress-nginx/controller:v1.11.1",
+			want:    "$IMAGE_REGISTRY/ingress-nginx-controller:v1.11.1",
+		},
+		{
+			name:    "official images",
+			profile: azure,
+			config:  &azure.Config,
+			img:     "redis:7.2.4",
+			want:    "$IMAGE_REGISTRY/redis:7.2.4",
+		},
+		{
+			name:    "rewrite rules are applied after the image map",
+			profile: azure,
+			config:  &MarketplaceConfig{ImageMap: map[string]string{"appscode/cluster-ui": "ui"}},
+			extra:   extra,
+			img:     "ghcr.io/appscode/cluster-ui:0.9.7",
+			want:    "$IMAGE_REGISTRY/kubedb/ui:0.9.7",
+		},
+		{
+			name:    "the profile flattens after the rewrite rules",
+			profile: gcp,
+			config:  &gcp.Config,
+			extra:   extra,
+			img:     "ghcr.io/appscode/cluster-ui:0.9.7",
+			want:    "$IMAGE_REGISTRY/cluster-ui:0.9.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, err := lib.NewRewriter("$IMAGE_REGISTRY", tt.profile.rewriteConfig(tt.config, tt.extra))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := rw.Target(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("target = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarketplaceValidate(t *testing.T) {
+	aws := marketplaceProfiles["aws"]
+	tests := []struct {
+		img  string
+		want int
+	}{
+		{img: "ghcr.io/appscode/cluster-ui:0.9.7", want: 0},
+		{img: "ghcr.io/appscode/cluster-ui:v0.9.7-rc.0", want: 0},
+		{img: "ghcr.io/appscode/cluster-ui:nightly", want: 1},
+		{img: "ghcr.io/appscode/cluster-ui:latest", want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.img, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := aws.validate(tt.img, ref); len(got) != tt.want {
+				t.Errorf("problems = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetCollisions(t *testing.T) {
+	image := func(img, target string) ScriptImage {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ScriptImage{Image: img, Ref: ref, Target: target}
+	}
+
+	tests := []struct {
+		name   string
+		images []ScriptImage
+		want   []string
+	}{
+		{
+			name: "different targets",
+			images: []ScriptImage{
+				image("ghcr.io/appscode/foo:1.0", "$IMAGE_REGISTRY/foo:$TAG"),
+				image("ghcr.io/appscode/bar:1.0", "$IMAGE_REGISTRY/bar:$TAG"),
+			},
+		},
+		{
+			name: "tags of the same repository",
+			images: []ScriptImage{
+				image("ghcr.io/appscode/foo:1.0", "$IMAGE_REGISTRY/foo:1.0"),
+				image("ghcr.io/appscode/foo:2.0", "$IMAGE_REGISTRY/foo:2.0"),
+			},
+		},
+		{
+			name: "same base name",
+			images: []ScriptImage{
+				image("ghcr.io/appscode/operator:1.0", "$IMAGE_REGISTRY/operator:$TAG"),
+				image("ghcr.io/kubedb/operator:1.0", "$IMAGE_REGISTRY/operator:$TAG"),
+				image("ghcr.io/kubedb/other:1.0", "$IMAGE_REGISTRY/other:$TAG"),
+			},
+			want: []string{
+				"$IMAGE_REGISTRY/operator: ghcr.io/appscode/operator, ghcr.io/kubedb/operator have the same target, give them different names in the image map of the marketplace config or with --rewrite-config",
+			},
+		},
+		{
+			name: "registry port",
+			images: []ScriptImage{
+				image("localhost:5000/a/foo:1.0", "localhost:5000/foo:1.0"),
+				image("localhost:5000/b/foo:1.0", "localhost:5000/foo:1.0"),
+			},
+			want: []string{
+				"localhost:5000/foo: localhost:5000/a/foo, localhost:5000/b/foo have the same target, give them different names in the image map of the marketplace config or with --rewrite-config",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targetCollisions(tt.images); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collisions = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCPValuesImages(t *testing.T) {
+	gcp := marketplaceProfiles["gcp"]
+	rw, err := lib.NewRewriter("$IMAGE_REGISTRY", gcp.rewriteConfig(&gcp.Config, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []ScriptImage
+	for _, img := range []string{
+		"ghcr.io/appscode/cluster-ui:0.9.7",
+		"registry.k8s.io/ingress-nginx/controller:v1.11.1",
+	} {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := rw.Repository(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, ScriptImage{Image: img, Ref: ref, Target: repo + ":" + gcp.TargetTag})
+	}
+
+	dir := t.TempDir()
+	if err := writeGCPSchemaImages(dir, rw, images); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, gcpValuesImagesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]map[string]map[string]string
+	if err := yaml.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	// the chart must be pointed at the images the sync script pushes
+	want := map[string]map[string]map[string]string{
+		"images": {
+			"cluster-ui": {
+				"registry":   "$IMAGE_REGISTRY",
+				"repository": "cluster-ui",
+				"tag":        "$TAG",
+			},
+			"ingress-nginx-controller": {
+				"registry":   "$IMAGE_REGISTRY",
+				"repository": "ingress-nginx-controller",
+				"tag":        "$TAG",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("values = %v, want %v", got, want)
+	}
+}
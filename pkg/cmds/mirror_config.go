@@ -0,0 +1,273 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	RuntimeContainerd = "containerd"
+	RuntimeK3s        = "k3s"
+	RuntimeCRIO       = "cri-o"
+)
+
+type MirrorConfigOptions struct {
+	// Insecure mirrors are served over plain HTTP.
+	Insecure bool
+	CAFile   string
+}
+
+func NewCmdGenerateMirrorConfig() *cobra.Command {
+	var (
+		files         []string
+		outDir        = "mirror-config"
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+		runtimes      = []string{RuntimeContainerd, RuntimeK3s, RuntimeCRIO}
+		opts          MirrorConfigOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "generate-mirror-config",
+		Short: "Generate container runtime configuration to pull images from the mirror registry",
+		Long: `Generate container runtime configuration to pull images from the mirror registry.
+
+For every source registry in the image lists, it writes
+  containerd: containerd/certs.d/<registry>/hosts.toml
+  k3s:        registries.yaml (also used by RKE2)
+  cri-o:      registries.conf.d/50-image-packer.conf
+
+containerd can not rewrite repository paths, so for containerd every image of
+a registry must keep its path under a common prefix in the mirror. Images that
+do not, like Docker Hub official images that lose their "library/" prefix under
+the default rewrite rules, are listed and no containerd configuration is
+written. The command only fails for them if containerd is given explicitly with
+--runtime; use --rewrite-config rules that keep their paths to mirror them for
+containerd.`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			for _, rt := range runtimes {
+				if !slices.Contains([]string{RuntimeContainerd, RuntimeK3s, RuntimeCRIO}, rt) {
+					return fmt.Errorf("unknown runtime %q", rt)
+				}
+			}
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+
+			images, err := GenerateImageList(files, false)
+			if err != nil {
+				return err
+			}
+			mirrors, err := lib.MirrorRegistries(images, rw)
+			if err != nil {
+				return err
+			}
+
+			out := map[string][]byte{}
+			if slices.Contains(runtimes, RuntimeContainerd) {
+				if err := checkContainerdMirrors(mirrors); err != nil {
+					// only the default runtimes leave containerd out quietly
+					if cmd.Flags().Changed("runtime") {
+						return err
+					}
+					klog.Warningf("skipping containerd configuration: %v", err)
+				} else {
+					for _, m := range mirrors {
+						out[filepath.Join("containerd", "certs.d", m.Registry, "hosts.toml")] = containerdHostsTOML(m, opts)
+					}
+				}
+			}
+			if slices.Contains(runtimes, RuntimeK3s) {
+				data, err := k3sRegistriesYAML(mirrors, opts)
+				if err != nil {
+					return err
+				}
+				out["registries.yaml"] = data
+			}
+			if slices.Contains(runtimes, RuntimeCRIO) {
+				out[filepath.Join("registries.conf.d", "50-image-packer.conf")] = crioRegistriesConf(mirrors, opts)
+			}
+
+			for filename, data := range out {
+				filename = filepath.Join(outDir, filename)
+				if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+					return err
+				}
+				if err := os.WriteFile(filename, data, 0o644); err != nil {
+					return err
+				}
+				fmt.Println("wrote", filename)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().StringVar(&outDir, "output-dir", outDir, "Output directory")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().StringSliceVar(&runtimes, "runtime", runtimes, "Container runtimes to generate configuration for (containerd, k3s, cri-o)")
+	cmd.Flags().BoolVar(&opts.Insecure, "insecure", opts.Insecure, "The mirror registry is served over plain HTTP")
+	cmd.Flags().StringVar(&opts.CAFile, "ca-file", "", "Path of the mirror registry CA certificate on the nodes")
+
+	return cmd
+}
+
+func mirrorEndpoint(host string, opts MirrorConfigOptions) string {
+	if opts.Insecure {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// checkContainerdMirrors fails with the repositories that containerd can not
+// find in the mirror, because their path does not follow the mirror prefix of
+// their registry.
+func checkContainerdMirrors(mirrors []lib.RegistryMirror) error {
+	var unmirrored []string
+	for _, m := range mirrors {
+		for _, r := range m.Repositories {
+			if !m.Follows(r) {
+				unmirrored = append(unmirrored, fmt.Sprintf("%s/%s -> %s/%s", m.Registry, r.Source, m.Host, r.Target))
+			}
+		}
+	}
+	if len(unmirrored) > 0 {
+		return fmt.Errorf("containerd can not rewrite repository paths, these repositories are not in the mirror under a common prefix:\n  %s\n"+
+			"leave containerd out of --runtime or use --rewrite-config rules that keep their paths", strings.Join(unmirrored, "\n  "))
+	}
+	return nil
+}
+
+func containerdHostsTOML(m lib.RegistryMirror, opts MirrorConfigOptions) []byte {
+	var buf bytes.Buffer
+	server := "https://" + m.Registry
+	if m.Registry == "docker.io" {
+		server = "https://registry-1.docker.io"
+	}
+	fmt.Fprintf(&buf, "server = %q\n\n", server)
+
+	host := mirrorEndpoint(m.Host, opts)
+	if m.Prefix != "" {
+		host += "/v2/" + m.Prefix
+	}
+	fmt.Fprintf(&buf, "[host.%q]\n", host)
+	buf.WriteString("  capabilities = [\"pull\", \"resolve\"]\n")
+	if m.Prefix != "" {
+		buf.WriteString("  override_path = true\n")
+	}
+	if opts.CAFile != "" {
+		fmt.Fprintf(&buf, "  ca = %q\n", opts.CAFile)
+	}
+	return buf.Bytes()
+}
+
+type k3sRegistries struct {
+	Mirrors map[string]k3sMirror `json:"mirrors"`
+	Configs map[string]k3sConfig `json:"configs,omitempty"`
+}
+
+type k3sMirror struct {
+	Endpoint []string          `json:"endpoint"`
+	Rewrite  map[string]string `json:"rewrite,omitempty"`
+}
+
+type k3sConfig struct {
+	TLS k3sTLS `json:"tls"`
+}
+
+type k3sTLS struct {
+	CAFile string `json:"ca_file"`
+}
+
+// k3sRegistriesYAML uses a single rewrite for uniform registries and one
+// anchored rewrite per repository otherwise.
+func k3sRegistriesYAML(mirrors []lib.RegistryMirror, opts MirrorConfigOptions) ([]byte, error) {
+	cfg := k3sRegistries{Mirrors: map[string]k3sMirror{}}
+	for _, m := range mirrors {
+		km := k3sMirror{Endpoint: []string{mirrorEndpoint(m.Host, opts)}}
+		if m.Uniform {
+			if m.Prefix != "" {
+				km.Rewrite = map[string]string{"^(.*)$": m.Prefix + "/$1"}
+			}
+		} else {
+			km.Rewrite = map[string]string{}
+			for _, r := range m.Repositories {
+				km.Rewrite["^"+regexp.QuoteMeta(r.Source)+"$"] = r.Target
+			}
+		}
+		cfg.Mirrors[m.Registry] = km
+
+		if opts.CAFile != "" {
+			if cfg.Configs == nil {
+				cfg.Configs = map[string]k3sConfig{}
+			}
+			cfg.Configs[m.Host] = k3sConfig{TLS: k3sTLS{CAFile: opts.CAFile}}
+		}
+	}
+	return yaml.Marshal(cfg)
+}
+
+// crioRegistriesConf mirrors a uniform registry as a whole and every
+// repository on its own otherwise.
+func crioRegistriesConf(mirrors []lib.RegistryMirror, opts MirrorConfigOptions) []byte {
+	var buf bytes.Buffer
+	entry := func(prefix, location string) {
+		fmt.Fprintf(&buf, "[[registry]]\nprefix = %q\nlocation = %q\n\n", prefix, prefix)
+		fmt.Fprintf(&buf, "[[registry.mirror]]\nlocation = %q\n", location)
+		if opts.Insecure {
+			buf.WriteString("insecure = true\n")
+		}
+		buf.WriteString("\n")
+	}
+	for _, m := range mirrors {
+		if m.Uniform {
+			location := m.Host
+			if m.Prefix != "" {
+				location += "/" + m.Prefix
+			}
+			entry(m.Registry, location)
+			continue
+		}
+		for _, r := range m.Repositories {
+			entry(m.Registry+"/"+r.Source, m.Host+"/"+r.Target)
+		}
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
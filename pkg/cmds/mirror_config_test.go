@@ -0,0 +1,88 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateMirrorConfigOfficialImages(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "images.yaml")
+	if err := os.WriteFile(list, []byte("- nginx:1.25\n- ghcr.io/appscode/cluster-ui:0.9.7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uniform := filepath.Join(dir, "uniform.yaml")
+	if err := os.WriteFile(uniform, []byte("- ghcr.io/appscode/cluster-ui:0.9.7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		src       string
+		args      []string
+		wantErr   bool
+		wantFiles []string
+		noFiles   []string
+	}{
+		{
+			name:      "default runtimes with uniform registries",
+			src:       uniform,
+			wantFiles: []string{"containerd/certs.d/ghcr.io/hosts.toml", "registries.yaml"},
+		},
+		{
+			name:      "default runtimes skip containerd",
+			wantFiles: []string{"registries.yaml", "registries.conf.d/50-image-packer.conf"},
+			noFiles:   []string{"containerd"},
+		},
+		{
+			name:    "explicit containerd fails",
+			args:    []string{"--runtime", "containerd,k3s"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := t.TempDir()
+			src := list
+			if tt.src != "" {
+				src = tt.src
+			}
+			cmd := NewCmdGenerateMirrorConfig()
+			cmd.SetArgs(append([]string{"--src", src, "--registry", "registry.example.com", "--output-dir", out}, tt.args...))
+			cmd.SetOut(io.Discard)
+			cmd.SetErr(io.Discard)
+			err := cmd.Execute()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, f := range tt.wantFiles {
+				if _, err := os.Stat(filepath.Join(out, f)); err != nil {
+					t.Errorf("%s was not written: %v", f, err)
+				}
+			}
+			for _, f := range tt.noFiles {
+				if _, err := os.Stat(filepath.Join(out, f)); !os.IsNotExist(err) {
+					t.Errorf("%s was written", f)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// The OpenShift config and operator APIs are not vendored, these types only
+// carry the fields the generated objects use.
+
+type openshiftObject struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        openshiftObjectMeta `json:"metadata"`
+	Spec            openshiftMirrorSpec `json:"spec"`
+}
+
+type openshiftObjectMeta struct {
+	Name string `json:"name"`
+}
+
+type openshiftMirrorSpec struct {
+	ImageDigestMirrors      []openshiftMirror `json:"imageDigestMirrors,omitempty"`
+	ImageTagMirrors         []openshiftMirror `json:"imageTagMirrors,omitempty"`
+	RepositoryDigestMirrors []openshiftMirror `json:"repositoryDigestMirrors,omitempty"`
+}
+
+type openshiftMirror struct {
+	Source             string   `json:"source"`
+	Mirrors            []string `json:"mirrors"`
+	MirrorSourcePolicy string   `json:"mirrorSourcePolicy,omitempty"`
+}
+
+func NewCmdGenerateOpenShiftMirrors() *cobra.Command {
+	var (
+		files              []string
+		outDir             = "openshift"
+		registry           = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig      string
+		objName            = "image-packer"
+		legacy             bool
+		neverContactSource bool
+	)
+	cmd := &cobra.Command{
+		Use:   "generate-openshift-mirrors",
+		Short: "Generate OpenShift ImageDigestMirrorSet and ImageTagMirrorSet objects for the mirror registry",
+		Long: `Generate OpenShift ImageDigestMirrorSet and ImageTagMirrorSet objects for the mirror registry.
+
+Repositories are grouped into as few sources as possible: a whole registry
+if all its repositories keep their path under the mirror, otherwise a
+namespace or a single repository. With --legacy, an ImageContentSourcePolicy
+is generated instead for clusters older than OpenShift 4.13.`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			if legacy && neverContactSource {
+				return errors.New("--never-contact-source is not supported by ImageContentSourcePolicy")
+			}
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+
+			images, err := GenerateImageList(files, false)
+			if err != nil {
+				return err
+			}
+			registries, err := lib.MirrorRegistries(images, rw)
+			if err != nil {
+				return err
+			}
+
+			var mirrors []openshiftMirror
+			for _, m := range registries {
+				for _, s := range m.Scopes() {
+					om := openshiftMirror{
+						Source:  m.Registry,
+						Mirrors: []string{m.Host},
+					}
+					if s.Source != "" {
+						om.Source += "/" + s.Source
+					}
+					if s.Target != "" {
+						om.Mirrors[0] += "/" + s.Target
+					}
+					if neverContactSource {
+						om.MirrorSourcePolicy = "NeverContactSource"
+					}
+					mirrors = append(mirrors, om)
+				}
+			}
+
+			objects := map[string]openshiftObject{}
+			if legacy {
+				objects["image-content-source-policy.yaml"] = openshiftObject{
+					TypeMeta: metav1.TypeMeta{APIVersion: "operator.openshift.io/v1alpha1", Kind: "ImageContentSourcePolicy"},
+					Metadata: openshiftObjectMeta{Name: objName},
+					Spec:     openshiftMirrorSpec{RepositoryDigestMirrors: mirrors},
+				}
+			} else {
+				objects["image-digest-mirror-set.yaml"] = openshiftObject{
+					TypeMeta: metav1.TypeMeta{APIVersion: "config.openshift.io/v1", Kind: "ImageDigestMirrorSet"},
+					Metadata: openshiftObjectMeta{Name: objName},
+					Spec:     openshiftMirrorSpec{ImageDigestMirrors: mirrors},
+				}
+				objects["image-tag-mirror-set.yaml"] = openshiftObject{
+					TypeMeta: metav1.TypeMeta{APIVersion: "config.openshift.io/v1", Kind: "ImageTagMirrorSet"},
+					Metadata: openshiftObjectMeta{Name: objName},
+					Spec:     openshiftMirrorSpec{ImageTagMirrors: mirrors},
+				}
+			}
+
+			if err := os.MkdirAll(outDir, 0o755); err != nil {
+				return err
+			}
+			for filename, obj := range objects {
+				data, err := yaml.Marshal(obj)
+				if err != nil {
+					return err
+				}
+				filename = filepath.Join(outDir, filename)
+				if err := os.WriteFile(filename, data, 0o644); err != nil {
+					return err
+				}
+				fmt.Println("wrote", filename)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().StringVar(&outDir, "output-dir", outDir, "Output directory")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().StringVar(&objName, "name", objName, "Name of the generated objects")
+	cmd.Flags().BoolVar(&legacy, "legacy", legacy, "Generate an ImageContentSourcePolicy instead of ImageDigestMirrorSet and ImageTagMirrorSet")
+	cmd.Flags().BoolVar(&neverContactSource, "never-contact-source", neverContactSource, "Never fall back to the source registry if the mirror fails")
+
+	return cmd
+}
@@ -0,0 +1,153 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"kmodules.xyz/go-containerregistry/name"
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+func NewCmdPostRender() *cobra.Command {
+	var (
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+		pinDigests    bool
+		insecure      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "post-render",
+		Short: "Helm post-renderer that rewrites images to the mirror registry and pins them by digest",
+		Long: `Helm post-renderer that rewrites images to the mirror registry and pins them by digest.
+
+Reads the rendered manifests from stdin and writes them to stdout with every
+image moved to the mirror registry. With --pin-digests, tags are replaced by
+the digest of the source image, so that the mirror can not serve a different
+image under the same tag. If the source registry is not reachable, as in an
+air-gapped cluster, the digest is resolved from the mirror instead. Images
+that can not be resolved keep their tag.
+
+Example:
+  IMAGE_REGISTRY=registry.example.com/mirror helm install kubedb ./kubedb \
+    --post-renderer image-packer \
+    --post-renderer-args post-render \
+    --post-renderer-args --pin-digests`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var rw *lib.Rewriter
+			if registry != "" {
+				cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+				if err != nil {
+					return err
+				}
+				if rw, err = lib.NewRewriter(registry, cfg); err != nil {
+					return err
+				}
+			}
+			var opts []crane.Option
+			if insecure {
+				opts = append(opts, crane.Insecure)
+			}
+
+			in, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			cache := map[string]string{}
+			out, err := lib.RewriteImages(in, func(img string) (string, error) {
+				if result, ok := cache[img]; ok {
+					return result, nil
+				}
+				result, pinned, err := mirrorImage(img, rw, pinDigests, opts)
+				if err != nil {
+					return "", err
+				}
+				if pinDigests && !pinned {
+					klog.Warningf("image %s not found, keeping its tag", result)
+				}
+				cache[img] = result
+				return result, nil
+			})
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(out)
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY), images are not moved if empty")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().BoolVar(&pinDigests, "pin-digests", pinDigests, "Replace image tags with digests")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+
+	return cmd
+}
+
+// mirrorImage moves img to the mirror if rw is set and pins it to the digest
+// of img if pin is set. The digest is resolved from the source registry and,
+// if that fails, from the mirror. It reports whether the result is pinned,
+// which it is not if the image was found in neither.
+func mirrorImage(img string, rw *lib.Rewriter, pin bool, opts []crane.Option) (string, bool, error) {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse image %s: %w", img, err)
+	}
+
+	result := img
+	if rw != nil {
+		repo, err := rw.Repository(img)
+		if err != nil {
+			return "", false, err
+		}
+		result = rw.Registry() + "/" + repo
+		if ref.Tag != "" {
+			result += ":" + ref.Tag
+		}
+		if ref.Digest != "" {
+			result += "@" + ref.Digest
+		}
+	}
+
+	if ref.Digest != "" {
+		return result, true, nil
+	}
+	if !pin {
+		return result, false, nil
+	}
+	digest, found, err := lib.ImageDigest(img, opts...)
+	if (err != nil || !found) && result != img {
+		if err != nil {
+			klog.V(3).Infof("failed to get digest for %s, trying %s: %v", img, result, err)
+		}
+		digest, found, err = lib.ImageDigest(result, opts...)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get digest for %s: %w", result, err)
+	}
+	if !found {
+		return result, false, nil
+	}
+	return stripTag(result) + "@" + digest, true, nil
+}
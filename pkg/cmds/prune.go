@@ -0,0 +1,107 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdPrune() *cobra.Command {
+	var (
+		files         []string
+		insecure      bool
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+		protect       []string
+		confirm       bool
+	)
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete images from the mirror registry that are not in the image lists",
+		Long: `Delete images from the mirror registry that are not in the image lists.
+
+Without --confirm, prune only prints what it would delete. Registries delete
+manifests by digest, so a manifest is kept as long as any retained or
+protected tag points to it. Images pinned by digest keep that digest, and
+the signatures, attestations and SBOMs attached to a kept manifest, by
+cosign tag or through the referrers API, are kept with it.
+
+prune fails if any --src cannot be read or if the lists hold no images.`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			if len(files) == 0 {
+				return errors.New("--src is required, it lists the images to keep")
+			}
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+			opts := lib.BundleOptions{Insecure: insecure}
+
+			// a list that fails to load must not turn into an empty set of
+			// images to keep
+			images, err := LoadImageLists(files)
+			if err != nil {
+				return err
+			}
+			plan, err := lib.PlanPrune(images, rw, protect, opts)
+			if err != nil {
+				return err
+			}
+
+			data := make([][]string, 0, len(plan.Candidates))
+			for _, c := range plan.Candidates {
+				data = append(data, []string{c.Repository, strings.Join(c.Tags, ", "), c.Digest})
+			}
+			if len(data) > 0 {
+				renderTable(os.Stdout, []string{"Repository", "Tags", "Digest"}, data)
+			}
+			fmt.Printf("%d manifests to delete, %d tags kept\n", len(plan.Candidates), plan.Kept)
+
+			if !confirm {
+				if len(plan.Candidates) > 0 {
+					fmt.Println("dry run, pass --confirm to delete")
+				}
+				return nil
+			}
+			return lib.Prune(plan.Candidates, opts)
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files with the images to keep (http url or local file)")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry and prefix to prune (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().StringSliceVar(&protect, "protect", protect, "Globs of repository:tag, relative to the registry prefix, that are never deleted (e.g. appscode/*:latest)")
+	cmd.Flags().BoolVar(&confirm, "confirm", confirm, "Delete the images instead of only listing them")
+
+	return cmd
+}
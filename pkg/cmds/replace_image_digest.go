@@ -17,105 +17,271 @@ limitations under the License.
 package cmds
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"kmodules.xyz/image-packer/pkg/lib"
 
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/cobra"
-	"sigs.k8s.io/yaml"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 // NewCmdReplaceImageDigest creates a new cobra command to replace image keys with digests in a YAML file
 func NewCmdReplaceImageDigest() *cobra.Command {
+	var (
+		inPlace  bool
+		check    bool
+		mode     = digestModeDigest
+		platform string
+	)
 	cmd := &cobra.Command{
-		Use:   "replace-image-digest <input.yaml> <output.yaml>",
+		Use:   "replace-image-digest <input.yaml> <output.yaml> | --in-place <path>...",
 		Short: "Replace image tag with image digest in a YAML file",
-		Long: `Recursively traverses a YAML document and replaces image tags with
+		Long: `Recursively traverses YAML documents and replaces image tags with
 their corresponding digests for "image" and "containerImage" keys.
 Tags are stripped so only the digest remains (e.g., nginx:1.21 becomes
-nginx@sha256:abc...).
+nginx@sha256:abc...), or kept in front of the digest with --mode=tag-digest
+(nginx:1.21@sha256:abc...). With --platform, images are pinned to the
+manifest of that platform instead of the image index. Only the image values are changed; comments, key
+order and formatting of the file are kept as they are. A file may hold
+several documents, and a document may be a map or a list.
 
-The input and output files can be the same for in-place editing.
+The input and output files can be the same for in-place editing. With
+--in-place, every argument is edited in place and may be a file, a
+directory, which is searched for *.yaml and *.yml files, or a glob.
+--check does not write any file, but fails if any file would change.
 
 Examples:
   image-packer replace-image-digest input.yaml output.yaml
-  image-packer replace-image-digest app.yaml app.yaml`,
-		Args: cobra.ExactArgs(2),
+  image-packer replace-image-digest app.yaml app.yaml
+  image-packer replace-image-digest --in-place charts/ 'deploy/*.yaml'
+  image-packer replace-image-digest --check charts/
+  image-packer replace-image-digest --mode=tag-digest --platform=linux/amd64 app.yaml app.yaml`,
+		DisableFlagsInUseLine: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			inputFile := args[0]
-			outputFile := args[1]
-			data, err := os.ReadFile(inputFile)
-			if err != nil {
-				return fmt.Errorf("failed to read input file: %w", err)
-			}
-			var m map[string]any
-			if err := yaml.Unmarshal(data, &m); err != nil {
-				return fmt.Errorf("failed to unmarshal YAML: %w", err)
-			}
-			changed, err := replaceImageKeysWithDigest(m)
+			r, err := newDigestReplacer(mode, platform)
 			if err != nil {
 				return err
 			}
-			out, err := yaml.Marshal(changed)
-			if err != nil {
-				return fmt.Errorf("failed to marshal YAML: %w", err)
+			if !inPlace && !check {
+				if len(args) != 2 {
+					return fmt.Errorf("expected <input.yaml> <output.yaml>, got %d arguments; use --in-place to edit files in place", len(args))
+				}
+				data, err := os.ReadFile(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to read input file: %w", err)
+				}
+				out, err := r.replace(data)
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				return os.WriteFile(args[1], out, 0o644)
+			}
+
+			if len(args) == 0 {
+				return errors.New("no files given")
 			}
-			return os.WriteFile(outputFile, out, 0o644)
+			return r.replaceFiles(args, check)
 		},
 	}
+	cmd.Flags().BoolVar(&inPlace, "in-place", inPlace, "Edit the given files, directories and globs in place")
+	cmd.Flags().BoolVar(&check, "check", check, "Do not write any file, fail if any file would change")
+	cmd.Flags().StringVar(&mode, "mode", mode, "Pinned image format: digest (repo@digest) or tag-digest (repo:tag@digest)")
+	cmd.Flags().StringVar(&platform, "platform", "", "Pin to the manifest of this platform (e.g. linux/amd64) instead of the image index")
 	return cmd
 }
 
-// replaceImageKeysWithDigest recursively replaces image and containerImage values with their digests
-func replaceImageKeysWithDigest(obj any) (any, error) {
-	switch v := obj.(type) {
-	case map[string]any:
-		for key, val := range v {
-			switch key {
-			case "image", "containerImage":
-				newVal, err := replaceImageWithDigest(val)
+// replaceFiles pins the images of the YAML files named by args in place. With
+// check, no file is written, but an error is returned if any file would
+// change.
+func (r *digestReplacer) replaceFiles(args []string, check bool) error {
+	files, err := yamlFiles(args)
+	if err != nil {
+		return err
+	}
+	var changed []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		out, err := r.replace(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		if bytes.Equal(data, out) {
+			continue
+		}
+		changed = append(changed, f)
+		if check {
+			fmt.Printf("%s: image tags are not pinned to digests\n", f)
+			continue
+		}
+		if err := os.WriteFile(f, out, 0o644); err != nil {
+			return err
+		}
+		fmt.Printf("%s: updated\n", f)
+	}
+	if check && len(changed) > 0 {
+		return fmt.Errorf("%d of %d files would change", len(changed), len(files))
+	}
+	return nil
+}
+
+// yamlFiles expands args into the list of YAML files they name. Directories
+// are searched recursively for *.yaml and *.yml files.
+func yamlFiles(args []string) ([]string, error) {
+	files := sets.New[string]()
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", arg)
+		}
+		for _, m := range matches {
+			err := filepath.WalkDir(m, func(p string, d fs.DirEntry, err error) error {
 				if err != nil {
-					return nil, err
+					return err
 				}
-				v[key] = newVal
-			default:
-				newVal, err := replaceImageKeysWithDigest(val)
-				if err != nil {
-					return nil, err
+				if d.IsDir() {
+					return nil
 				}
-				v[key] = newVal
-			}
-		}
-		return v, nil
-	case []any:
-		for i, item := range v {
-			newItem, err := replaceImageKeysWithDigest(item)
+				if p == m || strings.HasSuffix(p, ".yaml") || strings.HasSuffix(p, ".yml") {
+					files.Insert(p)
+				}
+				return nil
+			})
 			if err != nil {
 				return nil, err
 			}
-			v[i] = newItem
 		}
-		return v, nil
+	}
+	return sets.List(files), nil
+}
+
+const (
+	digestModeDigest    = "digest"
+	digestModeTagDigest = "tag-digest"
+)
+
+type digestResult struct {
+	img     string
+	changed bool
+}
+
+// digestReplacer looks up every image once, however many files refer to it.
+type digestReplacer struct {
+	keepTag bool
+	opts    []crane.Option
+	cache   map[string]digestResult
+	digest  func(ref string, opts ...crane.Option) (string, bool, error)
+}
+
+func newDigestReplacer(mode, platform string) (*digestReplacer, error) {
+	r := &digestReplacer{cache: map[string]digestResult{}, digest: lib.ImageDigest}
+	switch mode {
+	case digestModeDigest:
+	case digestModeTagDigest:
+		r.keepTag = true
 	default:
-		return v, nil
+		return nil, fmt.Errorf("unknown mode %q, supported modes are %s and %s", mode, digestModeDigest, digestModeTagDigest)
+	}
+	if platform != "" {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %w", platform, err)
+		}
+		r.opts = append(r.opts, crane.WithPlatform(p))
 	}
+	return r, nil
 }
 
-func replaceImageWithDigest(val any) (any, error) {
-	img, ok := val.(string)
-	if !ok || containsDigest(img) {
-		return val, nil
+// replace replaces the image and containerImage values of the YAML documents
+// in data with their digests. Only the image values are changed, the rest of
+// data is kept byte for byte.
+func (r *digestReplacer) replace(data []byte) ([]byte, error) {
+	var edits []lib.ScalarEdit
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
+		}
+		if err := r.replaceImageKeysWithDigest(&doc, &edits); err != nil {
+			return nil, err
+		}
+	}
+	return lib.ApplyScalarEdits(data, edits)
+}
+
+// replaceImageKeysWithDigest recursively collects the edits that replace image
+// and containerImage values with their digests
+func (r *digestReplacer) replaceImageKeysWithDigest(n *yaml.Node, edits *[]lib.ScalarEdit) error {
+	if n.Kind != yaml.MappingNode {
+		for _, c := range n.Content {
+			if err := r.replaceImageKeysWithDigest(c, edits); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	digest, found, err := lib.ImageDigest(img)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		switch k.Value {
+		case "image", "containerImage":
+			if v.Kind != yaml.ScalarNode || v.Tag != "!!str" {
+				continue
+			}
+			img, changed, err := r.replaceImageWithDigest(v.Value)
+			if err != nil {
+				return err
+			}
+			if changed {
+				*edits = append(*edits, lib.ScalarEdit{Node: v, Value: img})
+			}
+		default:
+			if err := r.replaceImageKeysWithDigest(v, edits); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *digestReplacer) replaceImageWithDigest(img string) (string, bool, error) {
+	if containsDigest(img) {
+		return img, false, nil
+	}
+	if res, ok := r.cache[img]; ok {
+		return res.img, res.changed, nil
+	}
+	digest, found, err := r.digest(img, r.opts...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get digest for %s: %w", img, err)
+		return "", false, fmt.Errorf("failed to get digest for %s: %w", img, err)
 	}
+	res := digestResult{img: img}
 	if found {
-		return fmt.Sprintf("%s@%s", stripTag(img), digest), nil
+		pinned := stripTag(img)
+		if r.keepTag {
+			pinned = img
+		}
+		res = digestResult{img: fmt.Sprintf("%s@%s", pinned, digest), changed: true}
 	}
-	return val, nil
+	r.cache[img] = res
+	return res.img, res.changed, nil
 }
 
 // containsDigest returns true if the image string contains an '@' (digest)
@@ -123,12 +289,13 @@ func containsDigest(img string) bool {
 	return strings.Contains(img, "@sha256:")
 }
 
-// stripTag removes the tag from an image reference (e.g., "nginx:1.21" -> "nginx")
+// stripTag removes the tag and digest from an image reference (e.g.,
+// "nginx:1.21" -> "nginx"). A colon before the last slash separates a
+// registry port, not a tag (e.g., "localhost:5000/nginx" is kept as is).
 func stripTag(img string) string {
-	if idx := strings.LastIndex(img, ":"); idx != -1 {
-		if slashIdx := strings.LastIndex(img, "/"); slashIdx < idx {
-			return img[:idx]
-		}
+	img, _, _ = strings.Cut(img, "@")
+	if idx := strings.LastIndex(img, ":"); idx > strings.LastIndex(img, "/") {
+		return img[:idx]
 	}
 	return img
 }
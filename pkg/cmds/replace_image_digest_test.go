@@ -0,0 +1,247 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+)
+
+func TestStripTag(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		img  string
+		want string
+	}{
+		{img: "nginx", want: "nginx"},
+		{img: "nginx:1.25", want: "nginx"},
+		{img: "ghcr.io/appscode/cluster-ui:0.9.7", want: "ghcr.io/appscode/cluster-ui"},
+		{img: "localhost:5000/nginx", want: "localhost:5000/nginx"},
+		{img: "localhost:5000/nginx:1.25", want: "localhost:5000/nginx"},
+		{img: "nginx@" + digest, want: "nginx"},
+		{img: "nginx:1.25@" + digest, want: "nginx"},
+		{img: "host:5000/repo@" + digest, want: "host:5000/repo"},
+		{img: "host:5000/repo:tag@" + digest, want: "host:5000/repo"},
+		{img: "$IMAGE_REGISTRY/cluster-ui:$TAG", want: "$IMAGE_REGISTRY/cluster-ui"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.img, func(t *testing.T) {
+			if got := stripTag(tt.img); got != tt.want {
+				t.Errorf("stripTag(%q) = %q, want %q", tt.img, got, tt.want)
+			}
+		})
+	}
+}
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newTestDigestReplacer returns a digestReplacer that knows the digest of
+// every image but "missing", without asking a registry.
+func newTestDigestReplacer(t *testing.T, mode string) *digestReplacer {
+	r, err := newDigestReplacer(mode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.digest = func(ref string, _ ...crane.Option) (string, bool, error) {
+		if stripTag(ref) == "missing" {
+			return "", false, nil
+		}
+		return testDigest, true, nil
+	}
+	return r
+}
+
+func TestDigestReplacer(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		in   string
+		want string
+	}{
+		{
+			name: "multiple documents",
+			mode: digestModeDigest,
+			in: `# first
+image: nginx:1.25
+---
+spec:
+  containers:
+  - name: app # keep me
+    image: "ghcr.io/appscode/cluster-ui:0.9.7"
+`,
+			want: `# first
+image: nginx@` + testDigest + `
+---
+spec:
+  containers:
+  - name: app # keep me
+    image: "ghcr.io/appscode/cluster-ui@` + testDigest + `"
+`,
+		},
+		{
+			name: "list at the root",
+			mode: digestModeTagDigest,
+			in: `- image: nginx:1.25
+- containerImage: localhost:5000/busybox
+- image: missing:1.0
+`,
+			want: `- image: nginx:1.25@` + testDigest + `
+- containerImage: localhost:5000/busybox@` + testDigest + `
+- image: missing:1.0
+`,
+		},
+		{
+			name: "already pinned and non-string values",
+			mode: digestModeDigest,
+			in: `image: nginx@` + testDigest + `
+containerImage: 1.0
+`,
+			want: `image: nginx@` + testDigest + `
+containerImage: 1.0
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestDigestReplacer(t, tt.mode).replace([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for f, content := range files {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestYAMLFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app.yaml":                       "",
+		"values.yml":                     "",
+		"README.md":                      "",
+		"charts/a/values.yaml":           "",
+		"charts/a/templates/deploy.yaml": "",
+		"charts/a/Chart.lock":            "",
+		"deploy/one.yaml":                "",
+		"deploy/two.yaml":                "",
+		"deploy/kustomization":           "",
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "file with any extension",
+			args: []string{"deploy/kustomization"},
+			want: []string{"deploy/kustomization"},
+		},
+		{
+			name: "directory is searched recursively",
+			args: []string{"charts"},
+			want: []string{"charts/a/templates/deploy.yaml", "charts/a/values.yaml"},
+		},
+		{
+			name: "glob",
+			args: []string{"deploy/*.yaml", "*.y*ml"},
+			want: []string{"app.yaml", "deploy/one.yaml", "deploy/two.yaml", "values.yml"},
+		},
+		{
+			name: "overlapping arguments are listed once",
+			args: []string{"deploy", "deploy/one.yaml"},
+			want: []string{"deploy/one.yaml", "deploy/two.yaml"},
+		},
+		{
+			name:    "missing path",
+			args:    []string{"nope.yaml"},
+			wantErr: true,
+		},
+		{
+			name:    "glob without matches",
+			args:    []string{"deploy/*.json"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := make([]string, 0, len(tt.args))
+			for _, arg := range tt.args {
+				args = append(args, filepath.Join(dir, arg))
+			}
+			got, err := yamlFiles(args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var want []string
+			for _, f := range tt.want {
+				want = append(want, filepath.Join(dir, f))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("files = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReplaceFilesCheck(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"pinned.yaml":   "image: nginx@" + testDigest + "\n",
+		"unpinned.yaml": "image: nginx:1.25\n",
+	}
+	writeFiles(t, dir, files)
+
+	r := newTestDigestReplacer(t, digestModeDigest)
+	if err := r.replaceFiles([]string{dir}, true); err == nil {
+		t.Error("check passed, but unpinned.yaml would change")
+	}
+	for f, content := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("check changed %s to %q", f, data)
+		}
+	}
+
+	if err := r.replaceFiles([]string{dir}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.replaceFiles([]string{dir}, true); err != nil {
+		t.Errorf("check failed after the files were pinned: %v", err)
+	}
+}
@@ -40,8 +40,20 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(NewCmdListEditorCharts())
 	rootCmd.AddCommand(NewCmdListFeatureCharts())
 	rootCmd.AddCommand(NewCmdGenerateScripts())
+	rootCmd.AddCommand(NewCmdGenerateOpenShiftMirrors())
+	rootCmd.AddCommand(NewCmdGenerateHelmValues())
+	rootCmd.AddCommand(NewCmdPostRender())
+	rootCmd.AddCommand(NewCmdKRMFunction())
+	rootCmd.AddCommand(NewCmdGenerateMarketplaceScript())
 	rootCmd.AddCommand(NewCmdGenerateGCPScript())
 	rootCmd.AddCommand(NewCmdGenerateCVEReport())
+	rootCmd.AddCommand(NewCmdBundle())
+	rootCmd.AddCommand(NewCmdSize())
+	rootCmd.AddCommand(NewCmdVerifyMirror())
+	rootCmd.AddCommand(NewCmdSync())
+	rootCmd.AddCommand(NewCmdPrune())
+	rootCmd.AddCommand(NewCmdServe())
+	rootCmd.AddCommand(NewCmdGenerateMirrorConfig())
 	rootCmd.AddCommand(NewCmdCompletion())
 	rootCmd.AddCommand(v.NewCmdVersion())
 
@@ -0,0 +1,171 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"kmodules.xyz/go-containerregistry/name"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Script templates are rendered with ScriptData. The top level templates
+// (export-images.sh.tmpl etc.) call the tool specific blocks "setup-export",
+// "setup-import", "setup-copy", "pull", "push" and "copy" defined in
+// tools/<tool>.tmpl. Blocks shared by the tools, like "verify-digest", are
+// defined in helpers.tmpl. Any of these files can be replaced with
+// --template-dir.
+//
+//go:embed templates
+var scriptTemplates embed.FS
+
+// scriptToolBases lists the tool templates another tool builds on.
+var scriptToolBases = map[string]string{
+	"rke2": "crane",
+}
+
+// nondistroTools lists the tools that can push non-distributable layers.
+var nondistroTools = sets.New("crane", "nerdctl", "rke2")
+
+// checkToolOptions returns an error for options the scripts of the tool can
+// not honor, instead of generating scripts that silently ignore them.
+func checkToolOptions(opts ScriptOptions) error {
+	if opts.Nondistro && !nondistroTools.Has(opts.Tool) {
+		return fmt.Errorf("tool %s can not push non-distributable layers, --allow-nondistributable-artifacts is supported by %s",
+			opts.Tool, strings.Join(sets.List(nondistroTools), ", "))
+	}
+	return nil
+}
+
+type ScriptData struct {
+	Tool    string
+	Options ScriptOptions
+	Images  []ScriptImage
+}
+
+type ScriptImage struct {
+	// Image is the image as listed in the source files.
+	Image string
+	// Source is the image pinned to Digest, or Image if the digest was not resolved.
+	Source string
+	// Digest is the manifest digest of the image when the scripts were generated.
+	Digest string
+	// PlatformDigests are the manifest and config digests of the platform
+	// images of Digest. Tools that push a single platform from a tarball are
+	// verified against these.
+	PlatformDigests []string
+	Ref             *name.Image
+	// Tarball is the path of the image tarball inside the bundle.
+	Tarball string
+	// Target is the image name in the mirror registry.
+	Target  string
+	Options ScriptOptions
+}
+
+func scriptTools() []string {
+	entries, err := scriptTemplates.ReadDir("templates/tools")
+	if err != nil {
+		panic(err)
+	}
+	tools := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		tools = append(tools, strings.TrimSuffix(entry.Name(), ".tmpl"))
+	}
+	sort.Strings(tools)
+	return tools
+}
+
+// loadScriptTemplates parses the embedded templates for tool and then the
+// files in dir, so that templates in dir replace the embedded ones by name.
+func loadScriptTemplates(tool, dir string) (*template.Template, error) {
+	toolFiles := []string{tool + ".tmpl"}
+	if base, ok := scriptToolBases[tool]; ok {
+		toolFiles = []string{base + ".tmpl", tool + ".tmpl"}
+	}
+	if _, err := fs.Stat(scriptTemplates, "templates/tools/"+tool+".tmpl"); err != nil {
+		return nil, fmt.Errorf("unknown tool %q, supported tools are %s", tool, strings.Join(scriptTools(), ", "))
+	}
+
+	// Scripts are parsed before tools, so that tool templates can override
+	// the blocks defined in the scripts.
+	sources := []fs.FS{mustSub(scriptTemplates, "templates")}
+	if dir != "" {
+		sources = append(sources, os.DirFS(dir))
+	}
+
+	tpl := template.New("scripts")
+	for _, fsys := range sources {
+		files, err := fs.Glob(fsys, "*.tmpl")
+		if err != nil {
+			return nil, err
+		}
+		if err := parseTemplateFiles(tpl, fsys, files); err != nil {
+			return nil, err
+		}
+	}
+	for _, fsys := range sources {
+		var files []string
+		for _, f := range toolFiles {
+			if _, err := fs.Stat(fsys, "tools/"+f); err == nil {
+				files = append(files, "tools/"+f)
+			}
+		}
+		if err := parseTemplateFiles(tpl, fsys, files); err != nil {
+			return nil, err
+		}
+	}
+	return tpl, nil
+}
+
+func parseTemplateFiles(tpl *template.Template, fsys fs.FS, files []string) error {
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return err
+		}
+		if _, err := tpl.New(path.Base(f)).Parse(string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+func renderScript(tpl *template.Template, script, outdir string, data any) error {
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, script+".tmpl", data); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(outdir, script), buf.Bytes(), 0o755)
+}
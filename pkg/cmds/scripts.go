@@ -28,8 +28,10 @@ import (
 	"strings"
 
 	"kmodules.xyz/go-containerregistry/name"
+	"kmodules.xyz/image-packer/pkg/lib"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
@@ -38,10 +40,9 @@ import (
 
 func NewCmdGenerateScripts() *cobra.Command {
 	var (
-		files     []string
-		nondistro bool
-		insecure  bool
-		outDir    string
+		files  []string
+		opts   = ScriptOptions{Tool: "crane"}
+		outDir string
 	)
 	cmd := &cobra.Command{
 		Use:                   "generate-scripts",
@@ -49,17 +50,33 @@ func NewCmdGenerateScripts() *cobra.Command {
 		DisableFlagsInUseLine: true,
 		DisableAutoGenTag:     true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return GenerateScripts(files, outDir, nondistro, insecure)
+			return GenerateScripts(files, outDir, opts)
 		},
 	}
 	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
-	cmd.Flags().BoolVar(&nondistro, "allow-nondistributable-artifacts", nondistro, "Allow pushing non-distributable (foreign) layers")
-	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().BoolVar(&opts.Nondistro, "allow-nondistributable-artifacts", opts.Nondistro, "Allow pushing non-distributable (foreign) layers (crane, nerdctl and rke2 only)")
+	cmd.Flags().BoolVar(&opts.Insecure, "insecure", opts.Insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&opts.Tool, "tool", opts.Tool, "Tool used by the generated scripts: "+strings.Join(scriptTools(), ", "))
+	cmd.Flags().StringVar(&opts.TemplateDir, "template-dir", "", "Directory with templates that replace the embedded script templates")
+	cmd.Flags().StringVar(&opts.RewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+	cmd.Flags().BoolVar(&opts.ResolveDigests, "resolve-digests", opts.ResolveDigests, "Record the digest of every image, pull by digest and verify the digest after push (needs access to the source registries)")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", opts.DryRun, "Print the source -> target mapping of every image without writing any script")
 	cmd.Flags().StringVar(&outDir, "output-dir", "", "Output directory")
 
 	return cmd
 }
 
+type ScriptOptions struct {
+	Tool              string
+	TemplateDir       string
+	RewriteConfig     string
+	MarketplaceConfig string
+	Nondistro         bool
+	Insecure          bool
+	ResolveDigests    bool
+	DryRun            bool
+}
+
 func GenerateImageList(files []string, uniqueTag bool) ([]string, error) {
 	if !uniqueTag {
 		images := sets.Set[string]{}
@@ -95,6 +112,20 @@ func GenerateImageList(files []string, uniqueTag bool) ([]string, error) {
 	return result, nil
 }
 
+// LoadImageLists is like GenerateImageList without uniqueTag, but fails if
+// any of the files cannot be read or downloaded instead of skipping it.
+func LoadImageLists(files []string) ([]string, error) {
+	images := sets.Set[string]{}
+	for _, file := range files {
+		list, err := loadImageList(file, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image list from %s: %w", file, err)
+		}
+		images.Insert(list...)
+	}
+	return sets.List(images), nil
+}
+
 func LoadLatestImageMap(file string, images map[string]string) error {
 	list, err := LoadImageList(file)
 	if err != nil {
@@ -134,12 +165,25 @@ func LoadImageMap(file string) (map[string][]string, error) {
 }
 
 func LoadImageList(file string) ([]string, error) {
+	return loadImageList(file, false)
+}
+
+// loadImageList reads the image list from a local file or an http url. A
+// download that does not return 200 OK is read as an empty list, unless
+// strict is set.
+func loadImageList(file string, strict bool) ([]string, error) {
 	if u, err := url.Parse(file); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
 		resp, err := http.Get(file)
-		if err != nil || resp.StatusCode != http.StatusOK {
+		if err != nil {
 			return nil, err
 		}
 		defer resp.Body.Close() // nolint:errcheck
+		if resp.StatusCode != http.StatusOK {
+			if !strict {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to download %s: %s", file, resp.Status)
+		}
 		var buf bytes.Buffer
 		_, err = io.Copy(&buf, resp.Body)
 		if err != nil {
@@ -165,205 +209,175 @@ func LoadImageList(file string) ([]string, error) {
 	return images, nil
 }
 
-func GenerateScripts(files []string, outdir string, nondistro, insecure bool) error {
-	images, err := GenerateImageList(files, false)
+func GenerateScripts(files []string, outdir string, opts ScriptOptions) error {
+	tpl, err := loadScriptTemplates(opts.Tool, opts.TemplateDir)
+	if err != nil {
+		return err
+	}
+	if err := checkToolOptions(opts); err != nil {
+		return err
+	}
+	cfg, err := lib.LoadRewriteConfig(opts.RewriteConfig)
+	if err != nil {
+		return err
+	}
+	rw, err := lib.NewRewriter("$IMAGE_REGISTRY", cfg)
 	if err != nil {
 		return err
 	}
 
-	var buf bytes.Buffer
-	buf.WriteString(`#!/bin/bash
-set -x
-
-mkdir -p images
-
-OS=$(uname -o)
-if [ "${OS}" = "GNU/Linux" ]; then
-  OS=Linux
-fi
-ARCH=$(uname -m)
-if [ "${ARCH}" = "aarch64" ]; then
-  ARCH=arm64
-fi
-curl -sL "https://github.com/google/go-containerregistry/releases/latest/download/go-containerregistry_${OS}_${ARCH}.tar.gz" > /tmp/go-containerregistry.tar.gz
-tar -zxvf /tmp/go-containerregistry.tar.gz -C /tmp/
-mv /tmp/crane images
-
-CMD="./images/crane"
+	images, err := GenerateImageList(files, false)
+	if err != nil {
+		return err
+	}
 
-`)
+	data := ScriptData{
+		Tool:    opts.Tool,
+		Options: opts,
+		Images:  make([]ScriptImage, 0, len(images)),
+	}
 	for _, img := range images {
 		// crane pull appscode/cluster-ui:0.4.16 images/cluster-ui.tar
 		ref, err := name.ParseReference(img)
 		if err != nil {
 			return err
 		}
-		if ref.Tag == "" {
-			return fmt.Errorf("image %s has no tag", img)
+		target, err := rw.Target(img)
+		if err != nil {
+			return err
 		}
-
-		buf.WriteString("$CMD pull")
-		if nondistro {
-			buf.WriteString(" --allow-nondistributable-artifacts")
+		si := ScriptImage{
+			Image:   img,
+			Source:  img,
+			Ref:     ref,
+			Tarball: tarballName(ref),
+			Target:  target,
+			Options: opts,
 		}
-		if insecure {
-			buf.WriteString(" --insecure")
+		if opts.ResolveDigests && !opts.DryRun {
+			si.Digest, si.Source, err = resolveDigest(img, ref, opts)
+			if err != nil {
+				return err
+			}
+			platforms, err := lib.PlatformDigests(si.Source, lib.BundleOptions{Insecure: opts.Insecure})
+			if err != nil {
+				return err
+			}
+			for _, d := range platforms {
+				if d != si.Digest {
+					si.PlatformDigests = append(si.PlatformDigests, d)
+				}
+			}
 		}
-		buf.WriteString(" ")
-		buf.WriteString(img)
-		buf.WriteString(" ")
-		buf.WriteString("images/" + strings.ReplaceAll(ref.Repository, "/", "-") + "-" + ref.Tag + ".tar")
-		buf.WriteRune('\n')
+		data.Images = append(data.Images, si)
 	}
 
-	buf.WriteRune('\n')
-	buf.WriteString(`tar -czvf images.tar.gz images
-`)
-	err = os.WriteFile(filepath.Join(outdir, "export-images.sh"), buf.Bytes(), 0o755)
-	if err != nil {
+	if err := checkScriptImages(data.Images); err != nil {
+		return err
+	}
+	if opts.DryRun {
+		printRewrites(data.Images)
+		return nil
+	}
+	if err := writeImageIndex(data.Images, filepath.Join(outdir, "image-index.yaml")); err != nil {
 		return err
 	}
 
-	buf.Reset()
-	buf.WriteString(`#!/bin/bash
-
-set -x
-
-if [ -z "${IMAGE_REGISTRY}" ]; then
-	echo "IMAGE_REGISTRY is not set"
-	exit 1
-fi
-
-TARBALL=${1:-}
-tar -zxvf $TARBALL
-
-CMD="./crane"
-
-`)
-	for _, img := range images {
-		// crane push images/cluster-ui.tar $IMAGE_REGISTRY/cluster-ui:0.4.16
-		ref, err := name.ParseReference(img)
-		if err != nil {
+	scripts := []string{"export-images.sh", "import-images.sh", "copy-images.sh"}
+	if opts.Tool == "crane" {
+		scripts = append(scripts, "import-into-k3s.sh")
+	}
+	for _, script := range scripts {
+		if err := renderScript(tpl, script, outdir, data); err != nil {
 			return err
 		}
-		if ref.Tag == "" {
-			return fmt.Errorf("image %s has no tag", img)
-		}
+	}
+	return nil
+}
 
-		buf.WriteString("$CMD push")
-		if nondistro {
-			buf.WriteString(" --allow-nondistributable-artifacts")
-		}
-		if insecure {
-			buf.WriteString(" --insecure")
-		}
-		buf.WriteString(" ")
-		buf.WriteString("images/" + strings.ReplaceAll(ref.Repository, "/", "-") + "-" + ref.Tag + ".tar")
-		buf.WriteString(" ")
-		if strings.HasPrefix(ref.Repository, "library/") {
-			buf.WriteString("$IMAGE_REGISTRY/" + ref.Repository[len("library/"):] + ":" + ref.Tag)
-		} else {
-			buf.WriteString("$IMAGE_REGISTRY/" + ref.Repository + ":" + ref.Tag)
-		}
-		buf.WriteRune('\n')
+// resolveDigest returns the current digest of img and the reference that
+// pulls img by that digest.
+func resolveDigest(img string, ref *name.Image, opts ScriptOptions) (string, string, error) {
+	var craneOpts []crane.Option
+	if opts.Insecure {
+		craneOpts = append(craneOpts, crane.Insecure)
 	}
-	err = os.WriteFile(filepath.Join(outdir, "import-images.sh"), buf.Bytes(), 0o755)
+	digest, found, err := lib.ImageDigest(img, craneOpts...)
 	if err != nil {
-		return err
+		return "", "", fmt.Errorf("failed to resolve %s: %w", img, err)
+	} else if !found {
+		return "", "", fmt.Errorf("image %s not found", img)
 	}
+	return digest, strings.TrimSuffix(img, ":"+ref.Tag) + "@" + digest, nil
+}
 
-	buf.Reset()
-	buf.WriteString(`#!/bin/bash
-
-set -x
-
-if [ -z "${IMAGE_REGISTRY}" ]; then
-	echo "IMAGE_REGISTRY is not set"
-	exit 1
-fi
+// tarballName encodes the full image reference, registry included, into the
+// tarball file name. "~", "+" and "=" can not appear in a registry, repository
+// or tag, so the name is unique per image and can be decoded back into the
+// reference: ghcr.io/appscode/cluster-ui:0.9.7 becomes
+// images/ghcr.io+appscode+cluster-ui=0.9.7.tar
+func tarballName(ref *name.Image) string {
+	return "images/" +
+		strings.ReplaceAll(ref.Registry, ":", "~") + "+" +
+		strings.ReplaceAll(ref.Repository, "/", "+") + "=" +
+		ref.Tag + ".tar"
+}
 
-TARBALL=${1:-}
-tar -zxvf $TARBALL
+// checkScriptImages fails if two images would share a tarball, also on case
+// insensitive file systems, or would be pushed to the same target.
+func checkScriptImages(images []ScriptImage) error {
+	tarballs := map[string]string{}
+	targets := map[string]string{}
 
-`)
+	var collisions []string
 	for _, img := range images {
-		// crane push images/cluster-ui.tar $IMAGE_REGISTRY/cluster-ui:0.4.16
-		ref, err := name.ParseReference(img)
-		if err != nil {
-			return err
+		if img.Tarball != "" {
+			key := strings.ToLower(img.Tarball)
+			if other, ok := tarballs[key]; ok {
+				collisions = append(collisions, fmt.Sprintf("%s and %s are both saved as %s", other, img.Image, img.Tarball))
+			}
+			tarballs[key] = img.Image
 		}
-		if ref.Tag == "" {
-			return fmt.Errorf("image %s has no tag", img)
+		if other, ok := targets[img.Target]; ok {
+			collisions = append(collisions, fmt.Sprintf("%s and %s are both pushed to %s", other, img.Image, img.Target))
 		}
-
-		buf.WriteString("k3s ctr images import")
-		buf.WriteString(" ")
-		buf.WriteString("images/" + strings.ReplaceAll(ref.Repository, "/", "-") + "-" + ref.Tag + ".tar")
-		buf.WriteRune('\n')
+		targets[img.Target] = img.Image
 	}
-	err = os.WriteFile(filepath.Join(outdir, "import-into-k3s.sh"), buf.Bytes(), 0o755)
-	if err != nil {
-		return err
+	if len(collisions) > 0 {
+		return fmt.Errorf("image name collisions found:\n%s", strings.Join(collisions, "\n"))
 	}
+	return nil
+}
 
-	buf.Reset()
-	buf.WriteString(`#!/bin/bash
-
-set -x
-
-if [ -z "${IMAGE_REGISTRY}" ]; then
-	echo "IMAGE_REGISTRY is not set"
-	exit 1
-fi
-
-OS=$(uname -o)
-if [ "${OS}" = "GNU/Linux" ]; then
-  OS=Linux
-fi
-ARCH=$(uname -m)
-if [ "${ARCH}" = "aarch64" ]; then
-  ARCH=arm64
-fi
-curl -sL "https://github.com/google/go-containerregistry/releases/latest/download/go-containerregistry_${OS}_${ARCH}.tar.gz" > /tmp/go-containerregistry.tar.gz
-tar -zxvf /tmp/go-containerregistry.tar.gz -C /tmp/
-mv /tmp/crane .
-
-CMD="./crane"
+type ImageIndexEntry struct {
+	Tarball string `json:"tarball"`
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Digest  string `json:"digest,omitempty"`
+}
 
-`)
+func writeImageIndex(images []ScriptImage, filename string) error {
+	index := make([]ImageIndexEntry, 0, len(images))
 	for _, img := range images {
-		// crane push images/cluster-ui.tar $IMAGE_REGISTRY/cluster-ui:0.4.16
-		ref, err := name.ParseReference(img)
-		if err != nil {
-			return err
-		}
-		if ref.Tag == "" {
-			return fmt.Errorf("image %s has no tag", img)
-		}
-
-		buf.WriteString("$CMD cp")
-		if nondistro {
-			buf.WriteString(" --allow-nondistributable-artifacts")
-		}
-		if insecure {
-			buf.WriteString(" --insecure")
-		}
-		buf.WriteString(" ")
-		buf.WriteString(img)
-		buf.WriteString(" ")
-		if strings.HasPrefix(ref.Repository, "library/") {
-			buf.WriteString("$IMAGE_REGISTRY/" + ref.Repository[len("library/"):] + ":" + ref.Tag)
-		} else {
-			buf.WriteString("$IMAGE_REGISTRY/" + ref.Repository + ":" + ref.Tag)
-		}
-		buf.WriteRune('\n')
+		index = append(index, ImageIndexEntry{
+			Tarball: img.Tarball,
+			Source:  img.Image,
+			Target:  img.Target,
+			Digest:  img.Digest,
+		})
 	}
-	err = os.WriteFile(filepath.Join(outdir, "copy-images.sh"), buf.Bytes(), 0o755)
+	data, err := yaml.Marshal(index)
 	if err != nil {
 		return err
 	}
+	return os.WriteFile(filename, data, 0o644)
+}
 
-	return nil
+// printRewrites prints where each image is pushed in the mirror registry.
+func printRewrites(images []ScriptImage) {
+	for _, img := range images {
+		fmt.Printf("%s -> %s\n", img.Image, img.Target)
+	}
 }
 
 func parseVersion(v string) (*semver.Version, error) {
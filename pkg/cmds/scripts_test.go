@@ -0,0 +1,261 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kmodules.xyz/go-containerregistry/name"
+)
+
+func TestTarballName(t *testing.T) {
+	tests := []struct {
+		img  string
+		want string
+	}{
+		{img: "ghcr.io/appscode/cluster-ui:0.9.7", want: "images/ghcr.io+appscode+cluster-ui=0.9.7.tar"},
+		{img: "nginx:1.25", want: "images/index.docker.io+library+nginx=1.25.tar"},
+		{img: "localhost:5000/a/b/c:v1", want: "images/localhost~5000+a+b+c=v1.tar"},
+		{img: "registry.k8s.io/pause:3.9", want: "images/registry.k8s.io+pause=3.9.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.img, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tarballName(ref); got != tt.want {
+				t.Errorf("tarballName(%s) = %s, want %s", tt.img, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarballNamesAreUnique(t *testing.T) {
+	// these collided when only the last path element and the tag were used
+	images := []string{
+		"ghcr.io/appscode/operator:v1",
+		"ghcr.io/kubedb/operator:v1",
+		"quay.io/appscode/operator:v1",
+		"ghcr.io/appscode/operator-v1:latest",
+		"ghcr.io/appscode-operator:v1",
+	}
+	seen := map[string]string{}
+	for _, img := range images {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarball := tarballName(ref)
+		if other, ok := seen[tarball]; ok {
+			t.Errorf("%s and %s are both saved as %s", other, img, tarball)
+		}
+		seen[tarball] = img
+	}
+}
+
+func TestCheckScriptImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		images  []ScriptImage
+		wantErr bool
+	}{
+		{
+			name: "no collisions",
+			images: []ScriptImage{
+				{Image: "ghcr.io/appscode/foo:1.0", Tarball: "images/a.tar", Target: "$IMAGE_REGISTRY/appscode/foo:1.0"},
+				{Image: "ghcr.io/appscode/bar:1.0", Tarball: "images/b.tar", Target: "$IMAGE_REGISTRY/appscode/bar:1.0"},
+			},
+		},
+		{
+			name: "same tarball",
+			images: []ScriptImage{
+				{Image: "ghcr.io/appscode/foo:1.0", Tarball: "images/a.tar", Target: "$IMAGE_REGISTRY/appscode/foo:1.0"},
+				{Image: "ghcr.io/appscode/bar:1.0", Tarball: "images/a.tar", Target: "$IMAGE_REGISTRY/appscode/bar:1.0"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "tarballs that differ only in case",
+			images: []ScriptImage{
+				{Image: "ghcr.io/appscode/foo:V1", Tarball: "images/foo=V1.tar", Target: "$IMAGE_REGISTRY/appscode/foo:V1"},
+				{Image: "ghcr.io/appscode/foo:v1", Tarball: "images/foo=v1.tar", Target: "$IMAGE_REGISTRY/appscode/foo:v1"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "same target",
+			images: []ScriptImage{
+				{Image: "ghcr.io/appscode/foo:1.0", Target: "$IMAGE_REGISTRY/foo:1.0"},
+				{Image: "quay.io/appscode/foo:1.0", Target: "$IMAGE_REGISTRY/foo:1.0"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "copy scripts have no tarballs",
+			images: []ScriptImage{
+				{Image: "ghcr.io/appscode/foo:1.0", Target: "$IMAGE_REGISTRY/appscode/foo:1.0"},
+				{Image: "ghcr.io/appscode/bar:1.0", Target: "$IMAGE_REGISTRY/appscode/bar:1.0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkScriptImages(tt.images)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkScriptImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateScriptsCtr(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "images.yaml")
+	if err := os.WriteFile(list, []byte("- nginx:1.25\n- registry.k8s.io/pause\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateScripts([]string{list}, dir, ScriptOptions{Tool: "ctr"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ctr neither defaults to Docker Hub nor to the latest tag
+	want := map[string][]string{
+		"export-images.sh": {
+			"$CMD images pull --all-platforms docker.io/library/nginx:1.25\n",
+			"$CMD images export images/index.docker.io+library+nginx=1.25.tar docker.io/library/nginx:1.25\n",
+			"$CMD images pull --all-platforms registry.k8s.io/pause:latest\n",
+		},
+		"import-images.sh": {
+			"$CMD images tag --force docker.io/library/nginx:1.25 $IMAGE_REGISTRY/nginx:1.25\n",
+			"$CMD images tag --force registry.k8s.io/pause:latest $IMAGE_REGISTRY/pause:latest\n",
+		},
+		"copy-images.sh": {
+			"$CMD images pull --all-platforms docker.io/library/nginx:1.25\n",
+			"$CMD images tag --force docker.io/library/nginx:1.25 $IMAGE_REGISTRY/nginx:1.25\n",
+		},
+	}
+	for script, lines := range want {
+		data, err := os.ReadFile(filepath.Join(dir, script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			if !strings.Contains(string(data), line) {
+				t.Errorf("%s does not contain %q:\n%s", script, line, data)
+			}
+		}
+	}
+}
+
+func TestCtrScriptsPinnedByDigest(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tpl, err := loadScriptTemplates("ctr", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference("nginx:1.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ScriptOptions{Tool: "ctr", ResolveDigests: true}
+	data := ScriptData{Tool: "ctr", Options: opts, Images: []ScriptImage{{
+		Image:   "nginx:1.25",
+		Source:  "nginx@" + digest,
+		Digest:  digest,
+		Ref:     ref,
+		Tarball: tarballName(ref),
+		Target:  "$IMAGE_REGISTRY/nginx:1.25",
+		Options: opts,
+	}}}
+
+	dir := t.TempDir()
+	for _, script := range []string{"export-images.sh", "import-images.sh"} {
+		if err := renderScript(tpl, script, dir, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export, err := os.ReadFile(filepath.Join(dir, "export-images.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"$CMD images pull --all-platforms docker.io/library/nginx@" + digest + "\n",
+		"$CMD images tag --force docker.io/library/nginx@" + digest + " docker.io/library/nginx:1.25\n",
+	} {
+		if !strings.Contains(string(export), line) {
+			t.Errorf("export-images.sh does not contain %q:\n%s", line, export)
+		}
+	}
+	imp, err := os.ReadFile(filepath.Join(dir, "import-images.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := `$($CMD images ls "name==$IMAGE_REGISTRY/nginx:1.25" | awk 'NR==2 {print $3}')`; !strings.Contains(string(imp), line) {
+		t.Errorf("import-images.sh does not look up the pushed name:\n%s", imp)
+	}
+}
+
+func TestCheckToolOptions(t *testing.T) {
+	// docker, podman, skopeo and ctr have no way to push foreign layers
+	supported := map[string]bool{"crane": true, "nerdctl": true, "rke2": true}
+	for _, tool := range scriptTools() {
+		t.Run(tool, func(t *testing.T) {
+			err := checkToolOptions(ScriptOptions{Tool: tool, Nondistro: true})
+			if want := supported[tool]; (err == nil) != want {
+				t.Errorf("error = %v, want nondistributable layers supported = %v", err, want)
+			}
+			if err := checkToolOptions(ScriptOptions{Tool: tool}); err != nil {
+				t.Errorf("error without options: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadImageListsDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("- nginx:1.25\n"))
+	}))
+	defer srv.Close()
+
+	images, err := LoadImageLists([]string{srv.URL + "/images.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"nginx:1.25"}; !reflect.DeepEqual(images, want) {
+		t.Errorf("images = %v, want %v", images, want)
+	}
+
+	// prune must not mistake a missing list for an empty one
+	if _, err := LoadImageLists([]string{srv.URL + "/missing.yaml"}); err == nil || !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("error = %v, want the download to fail", err)
+	}
+	// the other commands skip lists that can not be downloaded
+	if images, err := LoadImageList(srv.URL + "/missing.yaml"); err != nil || len(images) != 0 {
+		t.Errorf("images = %v, error = %v, want an empty list", images, err)
+	}
+}
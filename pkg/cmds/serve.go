@@ -0,0 +1,111 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+func NewCmdServe() *cobra.Command {
+	var (
+		bundleDir     string
+		publicKey     string
+		address       = ":5000"
+		rewriteConfig string
+		certFile      string
+		keyFile       string
+	)
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve an airgap bundle as a local read-only registry",
+		Long: `Serve an airgap bundle as a local read-only registry.
+
+The images are served under the repository names an import would give them,
+so with the default rewrite rules ghcr.io/appscode/foo:1.0 from the bundle is
+pulled as <host>:<port>/appscode/foo:1.0. The registry listens on --address
+and serves plain HTTP unless --tls-cert-file and --tls-key-file are set.
+
+Delta bundles are refused, as they lack the layers of their base bundle.
+
+Examples:
+  image-packer serve --bundle images --public-key bundle.pub --address :5000
+  image-packer serve --bundle images --public-key bundle.pub --address :5443 --tls-cert-file tls.crt --tls-key-file tls.key`,
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if bundleDir == "" {
+				return errors.New("--bundle is required")
+			}
+			if (certFile == "") != (keyFile == "") {
+				return errors.New("--tls-cert-file and --tls-key-file must be set together")
+			}
+
+			fsys, err := lib.OpenLayout(bundleDir)
+			if err != nil {
+				return err
+			}
+			if _, err := fs.Stat(fsys, lib.BundleManifestFile); err == nil {
+				mf, err := lib.VerifyBundle(fsys, publicKey)
+				if err != nil {
+					return err
+				}
+				if mf.Base != nil {
+					return errors.New("delta bundles can not be served, import the base bundle first")
+				}
+			} else if publicKey != "" {
+				return errors.New("--public-key requires a bundle with a bundle manifest")
+			}
+
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter("", cfg)
+			if err != nil {
+				return err
+			}
+			srv, err := lib.NewRegistryServer(fsys, rw)
+			if err != nil {
+				return err
+			}
+			for _, repo := range srv.Repositories() {
+				klog.Infof("serving %s", repo)
+			}
+
+			klog.Infof("listening on %s", address)
+			if certFile != "" {
+				return http.ListenAndServeTLS(address, certFile, keyFile, srv)
+			}
+			return http.ListenAndServe(address, srv)
+		},
+	}
+	cmd.Flags().StringVar(&bundleDir, "bundle", "", "Bundle, volume or OCI image layout directory to serve")
+	cmd.Flags().StringVar(&publicKey, "public-key", "", "Path to the ed25519 public key used to verify the bundle before serving it")
+	cmd.Flags().StringVar(&address, "address", address, "Address to listen on")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the served repositories")
+	cmd.Flags().StringVar(&certFile, "tls-cert-file", "", "File with the TLS certificate, serves plain HTTP if not set")
+	cmd.Flags().StringVar(&keyFile, "tls-key-file", "", "File with the TLS private key")
+
+	return cmd
+}
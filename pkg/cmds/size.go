@@ -0,0 +1,131 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/dustin/go-humanize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func NewCmdSize() *cobra.Command {
+	var (
+		files     []string
+		nondistro bool
+		insecure  bool
+		top       = 10
+		maxSize   string
+	)
+	cmd := &cobra.Command{
+		Use:                   "size",
+		Short:                 "Estimate the compressed size of the images before exporting them",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var budget int64
+			if maxSize != "" {
+				q, err := resource.ParseQuantity(maxSize)
+				if err != nil {
+					return fmt.Errorf("invalid --max-size: %w", err)
+				}
+				budget = q.Value()
+			}
+
+			images, err := GenerateImageList(files, false)
+			if err != nil {
+				return err
+			}
+			report, err := lib.EstimateSize(images, lib.BundleOptions{
+				Insecure:  insecure,
+				Nondistro: nondistro,
+			})
+			if err != nil {
+				return err
+			}
+			printSizeReport(os.Stdout, report, top)
+
+			if budget > 0 && report.Total > budget {
+				return fmt.Errorf("estimated size %s exceeds --max-size %s", humanize.IBytes(uint64(report.Total)), maxSize)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().BoolVar(&nondistro, "allow-nondistributable-artifacts", nondistro, "Count non-distributable (foreign) layers")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().IntVar(&top, "top", top, "Number of largest images to list")
+	cmd.Flags().StringVar(&maxSize, "max-size", "", "Fail if the deduplicated size exceeds this budget (e.g. 20Gi)")
+
+	return cmd
+}
+
+func printSizeReport(w io.Writer, report *lib.SizeReport, top int) {
+	var sum int64
+	data := make([][]string, 0, len(report.Images))
+	for _, img := range report.Images {
+		sum += img.Size
+		if len(img.Platforms) == 1 {
+			data = append(data, []string{img.Ref, img.Platforms[0].Platform, humanize.IBytes(uint64(img.Size))})
+			continue
+		}
+		for i, p := range img.Platforms {
+			ref := ""
+			if i == 0 {
+				ref = img.Ref
+			}
+			data = append(data, []string{ref, p.Platform, humanize.IBytes(uint64(p.Size))})
+		}
+		data = append(data, []string{"", "all", humanize.IBytes(uint64(img.Size))})
+	}
+	renderTable(w, []string{"Image", "Platform", "Size"}, data)
+
+	largest := make([]lib.ImageSize, len(report.Images))
+	copy(largest, report.Images)
+	sort.SliceStable(largest, func(i, j int) bool {
+		return largest[i].Size > largest[j].Size
+	})
+	if top > 0 && len(largest) > top {
+		largest = largest[:top]
+	}
+	data = make([][]string, 0, len(largest))
+	for _, img := range largest {
+		data = append(data, []string{img.Ref, humanize.IBytes(uint64(img.Size)), humanize.IBytes(uint64(img.Unique))})
+	}
+	_, _ = fmt.Fprintln(w, "\nLargest images:")
+	renderTable(w, []string{"Image", "Size", "Unique"}, data)
+
+	_, _ = fmt.Fprintf(w, "\nTotal: %s in %d blobs (%s without deduplication)\n",
+		humanize.IBytes(uint64(report.Total)), report.Blobs, humanize.IBytes(uint64(sum)))
+}
+
+func renderTable(w io.Writer, headers []string, data [][]string) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader(headers)
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.SetAutoWrapText(false)
+	table.AppendBulk(data)
+	table.Render()
+}
@@ -0,0 +1,89 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdSync() *cobra.Command {
+	var (
+		files         []string
+		nondistro     bool
+		insecure      bool
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+	)
+	cmd := &cobra.Command{
+		Use:                   "sync",
+		Short:                 "Copy images to the mirror registry, skipping those that are already up to date",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+
+			images, err := GenerateImageList(files, false)
+			if err != nil {
+				return err
+			}
+			results := lib.SyncImages(images, rw, lib.BundleOptions{
+				Insecure:  insecure,
+				Nondistro: nondistro,
+			})
+
+			counts := map[lib.SyncStatus]int{}
+			for _, r := range results {
+				counts[r.Status]++
+			}
+			fmt.Printf("copied: %d, skipped: %d, failed: %d\n",
+				counts[lib.SyncCopied], counts[lib.SyncSkipped], counts[lib.SyncFailed])
+
+			if counts[lib.SyncFailed] > 0 {
+				for _, r := range results {
+					if r.Status == lib.SyncFailed {
+						fmt.Printf("%s: %v\n", r.Source, r.Err)
+					}
+				}
+				return fmt.Errorf("failed to sync %d of %d images", counts[lib.SyncFailed], len(results))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().BoolVar(&nondistro, "allow-nondistributable-artifacts", nondistro, "Copy non-distributable (foreign) layers")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+
+	return cmd
+}
@@ -0,0 +1,127 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"kmodules.xyz/image-packer/pkg/lib"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCmdVerifyMirror() *cobra.Command {
+	var (
+		files         []string
+		bundleDir     string
+		publicKey     string
+		insecure      bool
+		registry      = os.Getenv("IMAGE_REGISTRY")
+		rewriteConfig string
+	)
+	cmd := &cobra.Command{
+		Use:                   "verify-mirror",
+		Short:                 "Verify that every image landed in the mirror registry with the source digest and platforms",
+		DisableFlagsInUseLine: true,
+		DisableAutoGenTag:     true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if registry == "" {
+				return errors.New("IMAGE_REGISTRY is not set")
+			}
+			if (len(files) == 0) == (bundleDir == "") {
+				return errors.New("exactly one of --src or --bundle-dir is required")
+			}
+
+			cfg, err := lib.LoadRewriteConfig(rewriteConfig)
+			if err != nil {
+				return err
+			}
+			rw, err := lib.NewRewriter(registry, cfg)
+			if err != nil {
+				return err
+			}
+			opts := lib.BundleOptions{Insecure: insecure}
+
+			var expected []lib.MirrorExpectation
+			if bundleDir != "" {
+				fsys, err := lib.OpenBundle(bundleDir)
+				if err != nil {
+					return err
+				}
+				mf, err := lib.ReadBundleManifest(fsys, publicKey)
+				if err != nil {
+					return err
+				}
+				expected, err = lib.ExpectFromBundle(fsys, mf)
+				if err != nil {
+					return err
+				}
+			} else {
+				// an unreadable list would otherwise verify nothing and pass
+				images, err := LoadImageLists(files)
+				if err != nil {
+					return err
+				}
+				if len(images) == 0 {
+					return errors.New("no images to verify")
+				}
+				expected, err = lib.ExpectFromRegistry(images, opts)
+				if err != nil {
+					return err
+				}
+			}
+
+			results, err := lib.VerifyMirror(expected, rw, opts)
+			if err != nil {
+				return err
+			}
+
+			var failed int
+			data := make([][]string, 0, len(results))
+			for _, r := range results {
+				status := "ok"
+				if !r.OK() {
+					status = r.Problem
+					failed++
+				}
+				data = append(data, []string{r.Source, r.Target, status})
+			}
+			renderTable(os.Stdout, []string{"Source", "Target", "Status"}, data)
+
+			if failed > 0 {
+				for _, r := range results {
+					if !r.OK() && r.Actual != "" {
+						fmt.Printf("%s: expected %s, found %s\n", r.Target, r.Expected, r.Actual)
+					}
+				}
+				return fmt.Errorf("%d of %d images failed verification", failed, len(results))
+			}
+			fmt.Printf("✔ %d images verified in %s\n", len(results), rw.Registry())
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&files, "src", files, "List of source files (http url or local file)")
+	cmd.Flags().StringVar(&bundleDir, "bundle-dir", "", "Bundle or volume directory to take the expected digests from instead of the source registries")
+	cmd.Flags().StringVar(&publicKey, "public-key", "", "Path to the ed25519 public key used to verify the bundle manifest")
+	cmd.Flags().BoolVar(&insecure, "insecure", insecure, "Allow image references to be fetched without TLS")
+	cmd.Flags().StringVar(&registry, "registry", registry, "Mirror registry (defaults to $IMAGE_REGISTRY)")
+	cmd.Flags().StringVar(&rewriteConfig, "rewrite-config", "", "YAML file with the rules that map source images to the target registry")
+
+	return cmd
+}
@@ -0,0 +1,81 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// cosignTagSuffixes are the tag suffixes cosign uses to attach signatures,
+// attestations and SBOMs to an image.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+type Artifact struct {
+	Descriptor v1.Descriptor
+	// Tag is the cosign tag of the artifact, empty for artifacts found through
+	// the referrers API.
+	Tag string
+}
+
+// ImageArtifacts returns the artifacts attached to the image digest, both
+// the ones listed by the OCI referrers API (or its tag schema fallback) and
+// the ones attached with the cosign tag convention sha256-<hex>.sig/.att/.sbom.
+func ImageArtifacts(digest name.Digest, opts ...remote.Option) ([]Artifact, error) {
+	var artifacts []Artifact
+	seen := sets.New[string]()
+
+	idx, err := remote.Referrers(digest, opts...)
+	if err != nil && !ImageNotFound(err) {
+		return nil, err
+	}
+	if idx != nil {
+		mf, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range mf.Manifests {
+			if seen.Has(desc.Digest.String()) {
+				continue
+			}
+			seen.Insert(desc.Digest.String())
+			artifacts = append(artifacts, Artifact{Descriptor: desc})
+		}
+	}
+
+	prefix := strings.Replace(digest.DigestStr(), ":", "-", 1)
+	for _, suffix := range cosignTagSuffixes {
+		tag := prefix + suffix
+		desc, err := remote.Head(digest.Context().Tag(tag), opts...)
+		if err != nil {
+			if ImageNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if seen.Has(desc.Digest.String()) {
+			continue
+		}
+		seen.Insert(desc.Digest.String())
+		artifacts = append(artifacts, Artifact{Descriptor: *desc, Tag: tag})
+	}
+	return artifacts, nil
+}
@@ -0,0 +1,955 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	v "gomodules.xyz/x/version"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+const (
+	BundleManifestFile  = "bundle.json"
+	BundleSignatureFile = "bundle.json.sig"
+	BundleFormatVersion = "v1"
+
+	annotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// BundleManifest describes the content of an airgap bundle. The bundle itself
+// is an OCI image layout; the manifest records what was exported so that it
+// can be verified before anything is pushed at the customer site.
+type BundleManifest struct {
+	Version     string        `json:"version"`
+	ToolVersion string        `json:"toolVersion,omitempty"`
+	Created     time.Time     `json:"created"`
+	Base        *BundleBase   `json:"base,omitempty"`
+	Images      []BundleImage `json:"images"`
+	Blobs       []BundleBlob  `json:"blobs"`
+}
+
+type BundleImage struct {
+	Ref       string   `json:"ref"`
+	Digest    string   `json:"digest"`
+	MediaType string   `json:"mediaType"`
+	Blobs     []string `json:"blobs"`
+	// Artifacts are the signatures, attestations and SBOMs attached to the
+	// image. Their blobs are included in Blobs.
+	Artifacts []BundleArtifact `json:"artifacts,omitempty"`
+	// Unchanged is set in a delta bundle for an image of the base that only
+	// carries new artifacts. The image manifest itself is not in the bundle.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+type BundleArtifact struct {
+	Digest       string `json:"digest"`
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType,omitempty"`
+	// Tag is the cosign tag of the artifact, empty if the artifact was found
+	// through the referrers API and is pushed by digest.
+	Tag string `json:"tag,omitempty"`
+}
+
+// BundleBase records the bundle a delta bundle was built against. Digest is
+// the sha256 of the base bundle manifest, empty if the base was an image list.
+type BundleBase struct {
+	Digest string        `json:"digest,omitempty"`
+	Images []BundleImage `json:"images"`
+}
+
+// blobs maps every blob of the base to the first base image that contains it.
+func (b *BundleBase) blobs() map[string]string {
+	result := map[string]string{}
+	for _, img := range b.Images {
+		for _, d := range img.Blobs {
+			if _, ok := result[d]; !ok {
+				result[d] = img.Ref
+			}
+		}
+	}
+	return result
+}
+
+type BundleBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type BundleOptions struct {
+	Insecure  bool
+	Nondistro bool
+	// Artifacts includes the artifacts attached to each image, see ImageArtifacts.
+	Artifacts bool
+}
+
+func (o BundleOptions) nameOptions() []name.Option {
+	if o.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+func (o BundleOptions) craneOptions() []crane.Option {
+	if o.Insecure {
+		return []crane.Option{crane.Insecure}
+	}
+	return nil
+}
+
+func (o BundleOptions) remoteOptions() []remote.Option {
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	if o.Nondistro {
+		opts = append(opts, remote.WithNondistributable)
+	}
+	return opts
+}
+
+// ExportBundle pulls the images into an OCI image layout in dir and writes a
+// bundle manifest next to it. The manifest is signed when a signing key is given.
+//
+// If base is set, the result is a delta bundle: images already in the base are
+// left out and layers shared with the base are not written.
+//
+// dir must not exist or be empty. Every blob in the layout is checksummed into
+// the manifest, so blobs left over from an earlier export would be signed too.
+func ExportBundle(images []string, dir, signingKey string, base *BundleBase, opts BundleOptions) (*BundleManifest, error) {
+	if entries, err := os.ReadDir(dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	} else if len(entries) > 0 {
+		return nil, fmt.Errorf("bundle directory %s is not empty, export into a new directory", dir)
+	}
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := BundleManifest{
+		Version:     BundleFormatVersion,
+		ToolVersion: v.Version.Version,
+		Created:     time.Now().UTC(),
+		Base:        base,
+		Images:      make([]BundleImage, 0, len(images)),
+	}
+	baseImages := map[string]BundleImage{}
+	skip := sets.New[string]()
+	if base != nil {
+		for _, img := range base.Images {
+			baseImages[img.Ref] = img
+		}
+		skip = sets.KeySet(base.blobs())
+	}
+
+	for _, img := range images {
+		ref, err := name.ParseReference(img, opts.nameOptions()...)
+		if err != nil {
+			return nil, err
+		}
+
+		// resolve the tag once and pull by digest, so that the recorded digest
+		// and the exported content can not drift apart
+		digest, found, err := ImageDigest(img, opts.craneOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", img, err)
+		} else if !found {
+			return nil, fmt.Errorf("image %s not found", img)
+		}
+		desc, err := remote.Get(ref.Context().Digest(digest), opts.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", img, err)
+		}
+		if b, ok := baseImages[img]; ok && b.Digest == desc.Digest.String() {
+			if !opts.Artifacts {
+				klog.Infof("skipping %s, unchanged since base bundle", img)
+				continue
+			}
+			// signatures and attestations may have been added since the base
+			exported := sets.New[string]()
+			for _, a := range b.Artifacts {
+				exported.Insert(a.Digest)
+			}
+			artifacts, blobs, err := exportArtifacts(p, ref.Context().Digest(digest), skip, exported, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to export artifacts of %s: %w", img, err)
+			}
+			if len(artifacts) == 0 {
+				klog.Infof("skipping %s, unchanged since base bundle", img)
+				continue
+			}
+			mf.Images = append(mf.Images, BundleImage{
+				Ref:       img,
+				Digest:    desc.Digest.String(),
+				MediaType: string(desc.MediaType),
+				Blobs:     sets.List(sets.New(blobs...)),
+				Artifacts: artifacts,
+				Unchanged: true,
+			})
+			continue
+		}
+		klog.Infof("exporting %s", img)
+
+		blobs, err := writeDescriptor(p, desc, img, skip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", img, err)
+		}
+		bi := BundleImage{
+			Ref:       img,
+			Digest:    desc.Digest.String(),
+			MediaType: string(desc.MediaType),
+		}
+
+		if opts.Artifacts {
+			artifacts, artifactBlobs, err := exportArtifacts(p, ref.Context().Digest(digest), skip, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to export artifacts of %s: %w", img, err)
+			}
+			bi.Artifacts = artifacts
+			blobs = append(blobs, artifactBlobs...)
+		}
+
+		bi.Blobs = sets.List(sets.New(blobs...))
+		mf.Images = append(mf.Images, bi)
+	}
+
+	mf.Blobs, err = checksumBlobs(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteBundleManifest(dir, &mf, signingKey); err != nil {
+		return nil, err
+	}
+	return &mf, nil
+}
+
+// exportArtifacts writes the artifacts attached to digest into the layout,
+// except for the ones in exclude. It returns the artifacts and their blobs.
+func exportArtifacts(p layout.Path, digest name.Digest, skip, exclude sets.Set[string], opts BundleOptions) ([]BundleArtifact, []string, error) {
+	artifacts, err := ImageArtifacts(digest, opts.remoteOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		result []BundleArtifact
+		blobs  []string
+	)
+	for _, a := range artifacts {
+		if exclude.Has(a.Descriptor.Digest.String()) {
+			continue
+		}
+		refName := digest.Context().Digest(a.Descriptor.Digest.String()).String()
+		if a.Tag != "" {
+			refName = digest.Context().Tag(a.Tag).String()
+		}
+		klog.Infof("exporting %s", refName)
+
+		ad, err := remote.Get(digest.Context().Digest(a.Descriptor.Digest.String()), opts.remoteOptions()...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch %s: %w", refName, err)
+		}
+		artifactBlobs, err := writeDescriptor(p, ad, refName, skip)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to write %s: %w", refName, err)
+		}
+		blobs = append(blobs, artifactBlobs...)
+		result = append(result, BundleArtifact{
+			Digest:       a.Descriptor.Digest.String(),
+			MediaType:    string(a.Descriptor.MediaType),
+			ArtifactType: a.Descriptor.ArtifactType,
+			Tag:          a.Tag,
+		})
+	}
+	return result, blobs, nil
+}
+
+// ImportBundle pushes every image listed in a verified bundle manifest to
+// the target registry. Layers left out of a delta bundle are mounted from the
+// base images, which must already be in the target registry.
+func ImportBundle(fsys fs.FS, mf *BundleManifest, rw *Rewriter, opts BundleOptions) error {
+	ii, err := layoutIndex(fsys)
+	if err != nil {
+		return err
+	}
+
+	local := sets.New[string]()
+	for _, b := range mf.Blobs {
+		local.Insert(b.Digest)
+	}
+	var baseBlobs map[string]string
+	if mf.Base != nil {
+		baseBlobs = mf.Base.blobs()
+	}
+
+	for _, img := range mf.Images {
+		target, err := rw.Target(img.Ref)
+		if err != nil {
+			return err
+		}
+		ref, err := name.ParseReference(target, opts.nameOptions()...)
+		if err != nil {
+			return err
+		}
+		h, err := v1.NewHash(img.Digest)
+		if err != nil {
+			return err
+		}
+		klog.Infof("importing %s as %s", img.Ref, target)
+
+		for _, blob := range img.Blobs {
+			if local.Has(blob) {
+				continue
+			}
+			if err := mountBaseBlob(rw, ref.Context(), blob, baseBlobs[blob], opts); err != nil {
+				return err
+			}
+		}
+
+		// unchanged images are in the target since the base bundle was imported
+		if !img.Unchanged {
+			if err := pushManifest(ii, ref, h, types.MediaType(img.MediaType), opts); err != nil {
+				return fmt.Errorf("failed to push %s: %w", target, err)
+			}
+		}
+
+		for _, a := range img.Artifacts {
+			ah, err := v1.NewHash(a.Digest)
+			if err != nil {
+				return err
+			}
+			var aref name.Reference = ref.Context().Digest(a.Digest)
+			if a.Tag != "" {
+				aref = ref.Context().Tag(a.Tag)
+			}
+			if err := pushManifest(ii, aref, ah, types.MediaType(a.MediaType), opts); err != nil {
+				return fmt.Errorf("failed to push %s: %w", aref, err)
+			}
+		}
+	}
+	return nil
+}
+
+// pushManifest pushes the image or index h of the bundle to ref and verifies
+// that the registry serves it with the same digest.
+func pushManifest(ii v1.ImageIndex, ref name.Reference, h v1.Hash, mediaType types.MediaType, opts BundleOptions) error {
+	if mediaType.IsIndex() {
+		idx, err := ii.ImageIndex(h)
+		if err != nil {
+			return err
+		}
+		if err := remote.WriteIndex(ref, idx, opts.remoteOptions()...); err != nil {
+			return err
+		}
+	} else {
+		image, err := ii.Image(h)
+		if err != nil {
+			return err
+		}
+		if err := remote.Write(ref, image, opts.remoteOptions()...); err != nil {
+			return err
+		}
+	}
+
+	desc, err := remote.Head(ref, opts.remoteOptions()...)
+	if err != nil {
+		return err
+	}
+	if desc.Digest != h {
+		return fmt.Errorf("digest mismatch: pushed %s, expected %s", desc.Digest, h)
+	}
+	return nil
+}
+
+// CheckBundleBase verifies that every image of the base bundle is already in
+// the target registry with the recorded digest.
+func CheckBundleBase(base *BundleBase, rw *Rewriter, opts BundleOptions) error {
+	var missing []string
+	for _, img := range base.Images {
+		target, err := rw.Target(img.Ref)
+		if err != nil {
+			return err
+		}
+		ref, err := name.ParseReference(target, opts.nameOptions()...)
+		if err != nil {
+			return err
+		}
+		desc, err := remote.Head(ref, opts.remoteOptions()...)
+		if err != nil {
+			if ImageNotFound(err) {
+				missing = append(missing, target+": not found")
+				continue
+			}
+			return err
+		}
+		if desc.Digest.String() != img.Digest {
+			missing = append(missing, fmt.Sprintf("%s: digest %s, expected %s", target, desc.Digest, img.Digest))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("base bundle content is missing from %s:\n%s", rw.Registry(), strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+func mountBaseBlob(rw *Rewriter, repo name.Repository, blob, baseImage string, opts BundleOptions) error {
+	if baseImage == "" {
+		return fmt.Errorf("blob %s is neither in the bundle nor in its base", blob)
+	}
+	src, err := rw.Target(baseImage)
+	if err != nil {
+		return err
+	}
+	srcRef, err := name.ParseReference(src, opts.nameOptions()...)
+	if err != nil {
+		return err
+	}
+	l, err := remote.Layer(srcRef.Context().Digest(blob), opts.remoteOptions()...)
+	if err != nil {
+		return err
+	}
+	return remote.WriteLayer(repo, &remote.MountableLayer{Layer: l, Reference: srcRef}, opts.remoteOptions()...)
+}
+
+// WriteBundleManifest writes the manifest into the bundle directory and, if
+// keyFile is set, a detached ed25519 signature of the manifest bytes.
+func WriteBundleManifest(dir string, mf *BundleManifest, keyFile string) error {
+	data, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, BundleManifestFile), data, 0o644); err != nil {
+		return err
+	}
+	if keyFile == "" {
+		// drop any signature left over from a previous export
+		err = os.Remove(filepath.Join(dir, BundleSignatureFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	key, err := LoadSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return os.WriteFile(filepath.Join(dir, BundleSignatureFile), []byte(sig+"\n"), 0o644)
+}
+
+// ReadBundleManifest reads the bundle manifest. If pubKeyFile is set, the
+// signature is checked before the manifest is parsed.
+func ReadBundleManifest(fsys fs.FS, pubKeyFile string) (*BundleManifest, error) {
+	data, err := fs.ReadFile(fsys, BundleManifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKeyFile != "" {
+		key, err := LoadVerificationKey(pubKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := fs.ReadFile(fsys, BundleSignatureFile)
+		if err != nil {
+			return nil, fmt.Errorf("bundle is not signed: %w", err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bundle signature: %w", err)
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return nil, errors.New("bundle signature verification failed")
+		}
+	}
+
+	var mf BundleManifest
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, err
+	}
+	if mf.Version != BundleFormatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %q", mf.Version)
+	}
+	return &mf, nil
+}
+
+// VerifyBundle checks the manifest signature and every blob checksum in the
+// bundle. It returns the manifest only if nothing is missing or modified.
+func VerifyBundle(fsys fs.FS, pubKeyFile string) (*BundleManifest, error) {
+	mf, err := ReadBundleManifest(fsys, pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	known := sets.New[string]()
+	for _, b := range mf.Blobs {
+		known.Insert(b.Digest)
+	}
+	if mf.Base != nil {
+		known = known.Union(sets.KeySet(mf.Base.blobs()))
+	}
+
+	var mismatched []string
+	for _, b := range mf.Blobs {
+		h, err := v1.NewHash(b.Digest)
+		if err != nil {
+			return nil, err
+		}
+		sum, size, err := checksumFile(fsys, blobPath(h))
+		if err != nil {
+			mismatched = append(mismatched, fmt.Sprintf("%s: %v", b.Digest, err))
+			continue
+		}
+		if sum != b.SHA256 || size != b.Size {
+			mismatched = append(mismatched, fmt.Sprintf("%s: checksum or size mismatch", b.Digest))
+		}
+	}
+	for _, img := range mf.Images {
+		for _, d := range img.Blobs {
+			if !known.Has(d) {
+				mismatched = append(mismatched, fmt.Sprintf("%s: blob %s is neither in the bundle nor in its base", img.Ref, d))
+			}
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return nil, fmt.Errorf("bundle verification failed:\n%s", strings.Join(mismatched, "\n"))
+	}
+	return mf, nil
+}
+
+// GenerateSigningKey writes a new ed25519 key pair as PEM encoded PKCS#8
+// private key and PKIX public key.
+func GenerateSigningKey(privFile, pubFile string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0o644)
+}
+
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", filename)
+	}
+	return priv, nil
+}
+
+func LoadVerificationKey(filename string) (ed25519.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", filename)
+	}
+	return pub, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	return block, nil
+}
+
+// LoadBundleBase reads a previous bundle manifest to be used as the base of a
+// delta bundle. If the previous bundle is itself a delta, its base images are
+// included too.
+func LoadBundleBase(filename string) (*BundleBase, error) {
+	var data []byte
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		fsys, err := OpenBundle(filename)
+		if err != nil {
+			return nil, err
+		}
+		data, err = fs.ReadFile(fsys, BundleManifestFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var mf BundleManifest
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil, err
+	}
+	if mf.Version != BundleFormatVersion {
+		return nil, fmt.Errorf("unsupported bundle version %q", mf.Version)
+	}
+
+	images := map[string]BundleImage{}
+	if mf.Base != nil {
+		for _, img := range mf.Base.Images {
+			images[img.Ref] = img
+		}
+	}
+	for _, img := range mf.Images {
+		if prev, ok := images[img.Ref]; ok && img.Unchanged {
+			// the image is in the base, only its new artifacts are in mf
+			prev.Artifacts = append(prev.Artifacts, img.Artifacts...)
+			prev.Blobs = sets.List(sets.New(prev.Blobs...).Insert(img.Blobs...))
+			img = prev
+		}
+		images[img.Ref] = img
+	}
+
+	sum := sha256.Sum256(data)
+	base := BundleBase{
+		Digest: "sha256:" + hex.EncodeToString(sum[:]),
+		Images: make([]BundleImage, 0, len(images)),
+	}
+	for _, ref := range sets.List(sets.KeySet(images)) {
+		base.Images = append(base.Images, images[ref])
+	}
+	return &base, nil
+}
+
+// ResolveBundleBase uses the images of a previous release as the base of a
+// delta bundle. Their digests and blobs are read from the source registries.
+func ResolveBundleBase(images []string, opts BundleOptions) (*BundleBase, error) {
+	base := BundleBase{
+		Images: make([]BundleImage, 0, len(images)),
+	}
+	for _, img := range images {
+		ref, err := name.ParseReference(img, opts.nameOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := remote.Get(ref, opts.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", img, err)
+		}
+
+		var blobs []string
+		if desc.MediaType.IsIndex() {
+			idx, err := desc.ImageIndex()
+			if err != nil {
+				return nil, err
+			}
+			blobs, err = indexBlobs(idx)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			image, err := desc.Image()
+			if err != nil {
+				return nil, err
+			}
+			blobs, err = imageBlobs(image)
+			if err != nil {
+				return nil, err
+			}
+		}
+		base.Images = append(base.Images, BundleImage{
+			Ref:       img,
+			Digest:    desc.Digest.String(),
+			MediaType: string(desc.MediaType),
+			Blobs:     sets.List(sets.New(blobs...)),
+		})
+	}
+	return &base, nil
+}
+
+// writeDescriptor writes the image or index desc and records it in the layout
+// index under refName. It returns the blobs of desc.
+func writeDescriptor(p layout.Path, desc *remote.Descriptor, refName string, skip sets.Set[string]) ([]string, error) {
+	var blobs []string
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		blobs, err = writeIndex(p, idx, skip)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		image, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		blobs, err = writeImage(p, image, skip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := desc.Descriptor
+	d.Annotations = map[string]string{annotationRefName: refName}
+	if err := p.AppendDescriptor(d); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// writeImage writes the manifest, config and layers of img into the layout,
+// except for layers listed in skip. It returns the digests of all blobs the
+// image refers to, skipped or not.
+func writeImage(p layout.Path, img v1.Image, skip sets.Set[string]) ([]string, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		d, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if skip.Has(d.String()) {
+			continue
+		}
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.WriteBlob(d, rc); err != nil {
+			return nil, err
+		}
+	}
+
+	cfgName, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.WriteBlob(cfgName, io.NopCloser(bytes.NewReader(cfg))); err != nil {
+		return nil, err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.WriteBlob(digest, io.NopCloser(bytes.NewReader(raw))); err != nil {
+		return nil, err
+	}
+	return imageBlobs(img)
+}
+
+func writeIndex(p layout.Path, idx v1.ImageIndex, skip sets.Set[string]) ([]string, error) {
+	mf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []string
+	for _, desc := range mf.Manifests {
+		var children []string
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			children, err = writeIndex(p, child, skip)
+			if err != nil {
+				return nil, err
+			}
+		} else if desc.MediaType.IsImage() {
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			children, err = writeImage(p, child, skip)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, fmt.Errorf("unsupported media type %s in index", desc.MediaType)
+		}
+		blobs = append(blobs, children...)
+	}
+
+	digest, err := idx.Digest()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := idx.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.WriteBlob(digest, io.NopCloser(bytes.NewReader(raw))); err != nil {
+		return nil, err
+	}
+	return append(blobs, digest.String()), nil
+}
+
+func imageBlobs(img v1.Image) ([]string, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mf, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	blobs := []string{digest.String(), mf.Config.Digest.String()}
+	for _, l := range mf.Layers {
+		blobs = append(blobs, l.Digest.String())
+	}
+	return blobs, nil
+}
+
+func indexBlobs(idx v1.ImageIndex) ([]string, error) {
+	digest, err := idx.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []string{digest.String()}
+	for _, desc := range mf.Manifests {
+		var children []string
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			children, err = indexBlobs(child)
+			if err != nil {
+				return nil, err
+			}
+		} else if desc.MediaType.IsImage() {
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			children, err = imageBlobs(child)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			children = []string{desc.Digest.String()}
+		}
+		blobs = append(blobs, children...)
+	}
+	return blobs, nil
+}
+
+func checksumBlobs(fsys fs.FS) ([]BundleBlob, error) {
+	var blobs []BundleBlob
+	err := fs.WalkDir(fsys, "blobs", func(name string, d fs.DirEntry, err error) error {
+		if name == "blobs" && errors.Is(err, fs.ErrNotExist) {
+			// nothing was written, e.g. a delta bundle without changes
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum, size, err := checksumFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		digest := strings.Replace(strings.TrimPrefix(name, "blobs/"), "/", ":", 1)
+		if digest != "sha256:"+sum {
+			return fmt.Errorf("blob %s does not match its digest", digest)
+		}
+		blobs = append(blobs, BundleBlob{Digest: digest, Size: size, SHA256: sum})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Digest < blobs[j].Digest })
+	return blobs, nil
+}
+
+func checksumFile(fsys fs.FS, name string) (string, int64, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close() // nolint:errcheck
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// OpenBundle returns the files of a bundle. path is either the bundle
+// directory or a directory of volumes written by SplitBundle, in which case
+// the files are read from the volumes directly.
+func OpenBundle(path string) (fs.FS, error) {
+	if _, err := os.Stat(filepath.Join(path, VolumeIndexFile)); err == nil {
+		return OpenVolumes(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, BundleManifestFile)); err != nil {
+		return nil, fmt.Errorf("%s is neither a bundle nor a volume set: %w", path, err)
+	}
+	return os.DirFS(path), nil
+}
+
+func blobPath(h v1.Hash) string {
+	return "blobs/" + h.Algorithm + "/" + h.Hex
+}
+
+// fsIndex is a v1.ImageIndex read from an OCI image layout in fsys, like
+// layout.Path but without requiring the layout to be on disk.
+type fsIndex struct {
+	fsys      fs.FS
+	mediaType types.MediaType
+	raw       []byte
+}
+
+var _ v1.ImageIndex = (*fsIndex)(nil)
+
+func layoutIndex(fsys fs.FS) (*fsIndex, error) {
+	raw, err := fs.ReadFile(fsys, "index.json")
+	if err != nil {
+		return nil, err
+	}
+	return &fsIndex{fsys: fsys, mediaType: types.OCIImageIndex, raw: raw}, nil
+}
+
+func (i *fsIndex) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *fsIndex) Digest() (v1.Hash, error) {
+	return partial.Digest(i)
+}
+
+func (i *fsIndex) Size() (int64, error) {
+	return partial.Size(i)
+}
+
+func (i *fsIndex) IndexManifest() (*v1.IndexManifest, error) {
+	var mf v1.IndexManifest
+	err := json.Unmarshal(i.raw, &mf)
+	return &mf, err
+}
+
+func (i *fsIndex) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *fsIndex) Image(h v1.Hash) (v1.Image, error) {
+	desc, err := i.findDescriptor(h)
+	if err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsImage() {
+		return nil, fmt.Errorf("unexpected media type for %v: %s", h, desc.MediaType)
+	}
+	raw, err := fs.ReadFile(i.fsys, blobPath(h))
+	if err != nil {
+		return nil, err
+	}
+	return partial.CompressedToImage(&fsImage{fsys: i.fsys, desc: *desc, raw: raw})
+}
+
+func (i *fsIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	desc, err := i.findDescriptor(h)
+	if err != nil {
+		return nil, err
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, fmt.Errorf("unexpected media type for %v: %s", h, desc.MediaType)
+	}
+	raw, err := fs.ReadFile(i.fsys, blobPath(h))
+	if err != nil {
+		return nil, err
+	}
+	return &fsIndex{fsys: i.fsys, mediaType: desc.MediaType, raw: raw}, nil
+}
+
+func (i *fsIndex) findDescriptor(h v1.Hash) (*v1.Descriptor, error) {
+	mf, err := i.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range mf.Manifests {
+		if desc.Digest == h {
+			return &desc, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find descriptor in index: %s", h)
+}
+
+type fsImage struct {
+	fsys fs.FS
+	desc v1.Descriptor
+	raw  []byte
+}
+
+var _ partial.CompressedImageCore = (*fsImage)(nil)
+
+func (i *fsImage) MediaType() (types.MediaType, error) {
+	return i.desc.MediaType, nil
+}
+
+func (i *fsImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *fsImage) Manifest() (*v1.Manifest, error) {
+	return partial.Manifest(i)
+}
+
+func (i *fsImage) RawConfigFile() ([]byte, error) {
+	mf, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(i.fsys, blobPath(mf.Config.Digest))
+}
+
+func (i *fsImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	mf, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	if h == mf.Config.Digest {
+		return &fsBlob{fsys: i.fsys, desc: mf.Config}, nil
+	}
+	for _, desc := range mf.Layers {
+		if h == desc.Digest {
+			return &fsBlob{fsys: i.fsys, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find layer in image: %s", h)
+}
+
+type fsBlob struct {
+	fsys fs.FS
+	desc v1.Descriptor
+}
+
+func (b *fsBlob) Digest() (v1.Hash, error) {
+	return b.desc.Digest, nil
+}
+
+func (b *fsBlob) Compressed() (io.ReadCloser, error) {
+	return b.fsys.Open(blobPath(b.desc.Digest))
+}
+
+func (b *fsBlob) Size() (int64, error) {
+	return b.desc.Size, nil
+}
+
+func (b *fsBlob) MediaType() (types.MediaType, error) {
+	return b.desc.MediaType, nil
+}
+
+// Descriptor implements partial.withDescriptor.
+func (b *fsBlob) Descriptor() (*v1.Descriptor, error) {
+	return &b.desc, nil
+}
+
+// Exists implements partial.Exists, layers left out of a delta bundle do not.
+func (b *fsBlob) Exists() (bool, error) {
+	_, err := fs.Stat(b.fsys, blobPath(b.desc.Digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
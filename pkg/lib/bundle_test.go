@@ -0,0 +1,346 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// testImage builds an image with one layer per content, each holding a
+// single file.
+func testImage(t *testing.T, contents ...string) v1.Image {
+	t.Helper()
+	img := empty.Image
+	for _, content := range contents {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = mutate.AppendLayers(img, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return img
+}
+
+// testSigningKey generates a key pair outside of any bundle directory.
+func testSigningKey(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	priv, pub := filepath.Join(dir, "bundle.key"), filepath.Join(dir, "bundle.pub")
+	if err := GenerateSigningKey(priv, pub); err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+// exportTestBundle writes images into a new bundle the way ExportBundle does,
+// without pulling them from a registry. Blobs of base are left out.
+func exportTestBundle(t *testing.T, images map[string]v1.Image, base *BundleBase, keyFile string) (string, *BundleManifest) {
+	t.Helper()
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skip := sets.New[string]()
+	if base != nil {
+		skip = sets.KeySet(base.blobs())
+	}
+
+	mf := BundleManifest{
+		Version: BundleFormatVersion,
+		Created: time.Now().UTC(),
+		Base:    base,
+	}
+	for _, ref := range sets.List(sets.KeySet(images)) {
+		img := images[ref]
+		blobs, err := writeImage(p, img, skip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt, err := img.MediaType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := img.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.AppendDescriptor(v1.Descriptor{
+			MediaType:   mt,
+			Digest:      digest,
+			Size:        size,
+			Annotations: map[string]string{annotationRefName: ref},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mf.Images = append(mf.Images, BundleImage{
+			Ref:       ref,
+			Digest:    digest.String(),
+			MediaType: string(mt),
+			Blobs:     sets.List(sets.New(blobs...)),
+		})
+	}
+
+	mf.Blobs, err = checksumBlobs(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBundleManifest(dir, &mf, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	return dir, &mf
+}
+
+func layerBlobPath(t *testing.T, dir string, img v1.Image, i int) string {
+	t.Helper()
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := layers[i].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, filepath.FromSlash(blobPath(d)))
+}
+
+func TestVerifyBundle(t *testing.T) {
+	priv, pub := testSigningKey(t)
+	otherPriv, _ := testSigningKey(t)
+	img := testImage(t, "one", "two")
+	images := map[string]v1.Image{"ghcr.io/appscode/cluster-ui:0.9.7": img}
+
+	tests := []struct {
+		name    string
+		key     string
+		pubKey  string
+		modify  func(t *testing.T, dir string, mf *BundleManifest)
+		wantErr string
+	}{
+		{
+			name:   "signed bundle",
+			key:    priv,
+			pubKey: pub,
+		},
+		{
+			name: "unsigned bundle without a public key",
+		},
+		{
+			name:    "unsigned bundle with a public key",
+			pubKey:  pub,
+			wantErr: "bundle is not signed",
+		},
+		{
+			name:   "tampered manifest",
+			key:    priv,
+			pubKey: pub,
+			modify: func(t *testing.T, dir string, _ *BundleManifest) {
+				p := filepath.Join(dir, BundleManifestFile)
+				data, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = bytes.Replace(data, []byte("cluster-ui"), []byte("evil-ui"), 1)
+				if err := os.WriteFile(p, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "bundle signature verification failed",
+		},
+		{
+			name:   "manifest signed with another key",
+			key:    priv,
+			pubKey: pub,
+			modify: func(t *testing.T, dir string, mf *BundleManifest) {
+				if err := WriteBundleManifest(dir, mf, otherPriv); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "bundle signature verification failed",
+		},
+		{
+			name:   "blob with a wrong checksum",
+			key:    priv,
+			pubKey: pub,
+			modify: func(t *testing.T, dir string, _ *BundleManifest) {
+				if err := os.WriteFile(layerBlobPath(t, dir, img, 1), []byte("evil"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "checksum or size mismatch",
+		},
+		{
+			name:   "missing blob",
+			key:    priv,
+			pubKey: pub,
+			modify: func(t *testing.T, dir string, _ *BundleManifest) {
+				if err := os.Remove(layerBlobPath(t, dir, img, 0)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "no such file or directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, mf := exportTestBundle(t, images, nil, tt.key)
+			if tt.modify != nil {
+				tt.modify(t, dir, mf)
+			}
+			got, err := VerifyBundle(os.DirFS(dir), tt.pubKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Images, mf.Images) || !reflect.DeepEqual(got.Blobs, mf.Blobs) {
+				t.Errorf("manifest = %+v, want %+v", got, mf)
+			}
+		})
+	}
+}
+
+func TestWriteBundleManifestDropsStaleSignature(t *testing.T) {
+	priv, pub := testSigningKey(t)
+	dir, mf := exportTestBundle(t, map[string]v1.Image{"nginx:1.25": testImage(t, "one")}, nil, priv)
+	if err := WriteBundleManifest(dir, mf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyBundle(os.DirFS(dir), pub); err == nil || !strings.Contains(err.Error(), "bundle is not signed") {
+		t.Errorf("error = %v, want the bundle to be unsigned", err)
+	}
+}
+
+func TestDeltaBundle(t *testing.T) {
+	priv, pub := testSigningKey(t)
+	baseImg := testImage(t, "shared")
+	newImg := testImage(t, "shared", "new")
+	baseBlobs, err := imageBlobs(baseImg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDigest, err := baseImg.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseMediaType, err := baseImg.MediaType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &BundleBase{Images: []BundleImage{{
+		Ref:       "ghcr.io/appscode/cluster-ui:0.9.6",
+		Digest:    baseDigest.String(),
+		MediaType: string(baseMediaType),
+		Blobs:     sets.List(sets.New(baseBlobs...)),
+	}}}
+	images := map[string]v1.Image{"ghcr.io/appscode/cluster-ui:0.9.7": newImg}
+
+	t.Run("shared layers are left out", func(t *testing.T) {
+		dir, _ := exportTestBundle(t, images, base, priv)
+		if _, err := os.Stat(layerBlobPath(t, dir, newImg, 0)); !os.IsNotExist(err) {
+			t.Errorf("shared layer was written to the delta bundle: %v", err)
+		}
+		if _, err := os.Stat(layerBlobPath(t, dir, newImg, 1)); err != nil {
+			t.Errorf("new layer is missing from the delta bundle: %v", err)
+		}
+		if _, err := VerifyBundle(os.DirFS(dir), pub); err != nil {
+			t.Errorf("delta bundle does not verify: %v", err)
+		}
+	})
+
+	t.Run("blobs must be in the base", func(t *testing.T) {
+		dir, mf := exportTestBundle(t, images, base, priv)
+		mf.Base = &BundleBase{}
+		if err := WriteBundleManifest(dir, mf, priv); err != nil {
+			t.Fatal(err)
+		}
+		_, err := VerifyBundle(os.DirFS(dir), pub)
+		if err == nil || !strings.Contains(err.Error(), "is neither in the bundle nor in its base") {
+			t.Errorf("error = %v, want the shared layer to be missing", err)
+		}
+
+		// nothing is pushed for a blob that can not be mounted from the base
+		rw, err := NewRewriter("registry.example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ImportBundle(os.DirFS(dir), mf, rw, BundleOptions{})
+		if err == nil || !strings.Contains(err.Error(), "is neither in the bundle nor in its base") {
+			t.Errorf("import error = %v, want the shared layer to be missing", err)
+		}
+	})
+
+	t.Run("base of the next delta", func(t *testing.T) {
+		dir, _ := exportTestBundle(t, images, base, priv)
+		got, err := LoadBundleBase(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var refs []string
+		for _, img := range got.Images {
+			refs = append(refs, img.Ref)
+		}
+		want := []string{"ghcr.io/appscode/cluster-ui:0.9.6", "ghcr.io/appscode/cluster-ui:0.9.7"}
+		if !reflect.DeepEqual(refs, want) {
+			t.Errorf("base images = %v, want %v", refs, want)
+		}
+		if !strings.HasPrefix(got.Digest, "sha256:") {
+			t.Errorf("base digest = %q, want the digest of the manifest", got.Digest)
+		}
+	})
+}
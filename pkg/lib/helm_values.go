@@ -0,0 +1,308 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kmodules.xyz/go-containerregistry/name"
+
+	gname "github.com/google/go-containerregistry/pkg/name"
+	"sigs.k8s.io/yaml"
+)
+
+// ValuesOverride sets the value at Path in the chart values.
+type ValuesOverride struct {
+	Path  []string
+	Value string
+	// Image is the rendered image the override rewrites.
+	Image string
+}
+
+// LoadChartValues returns the values a chart is rendered with by MapImages:
+// values.yaml, the *.sample.yaml files and content, merged in that order.
+func LoadChartValues(rootDir, chartName, content string) (map[string]any, error) {
+	files := []string{filepath.Join(rootDir, chartName, "values.yaml")}
+	samples, err := filepath.Glob(filepath.Join(rootDir, chartName, "*.sample.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, samples...)
+
+	values := map[string]any{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var m map[string]any
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		mergeValues(values, m)
+	}
+	if content != "" {
+		var m map[string]any
+		if err := yaml.Unmarshal([]byte(content), &m); err != nil {
+			return nil, err
+		}
+		mergeValues(values, m)
+	}
+	return values, nil
+}
+
+func mergeValues(dst, src map[string]any) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]any); ok {
+			if dm, ok := dst[k].(map[string]any); ok {
+				mergeValues(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// AirgapOverrides finds the values that produce the rendered images and
+// returns the overrides that point them at the target registry of rw. It
+// understands images given as a single string and as maps with a repository
+// (or image) key and an optional registry key. A registry host shared by all
+// images, like registryFQDN, is replaced by the target registry. Images no
+// value could be found for are returned as unresolved.
+func AirgapOverrides(values map[string]any, images []string, rw *Rewriter) ([]ValuesOverride, []string, error) {
+	type rendered struct {
+		image    string
+		ref      *name.Image
+		variants []string
+	}
+	refs := make([]rendered, 0, len(images))
+	for _, img := range images {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = append(refs, rendered{image: img, ref: ref, variants: repoVariants(ref)})
+	}
+
+	resolved := map[string]bool{}
+	overrides := map[string]ValuesOverride{}
+	set := func(p []string, value, img string) {
+		overrides[strings.Join(p, "\x00")] = ValuesOverride{Path: p, Value: value, Image: img}
+		resolved[img] = true
+	}
+
+	leaves := map[string][]string{}
+	walkValues(values, nil, func(p []string, m map[string]any) {
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				leaves[s] = append(leaves[s], strings.Join(append(append([]string{}, p...), k), "\x00"))
+			}
+		}
+	})
+
+	var err error
+	walkValues(values, nil, func(p []string, m map[string]any) {
+		if err != nil {
+			return
+		}
+		// images given as a single string
+		for k, v := range m {
+			s, ok := v.(string)
+			if !ok || !strings.Contains(path.Base(s), ":") {
+				continue
+			}
+			ref, e := name.ParseReference(s)
+			if e != nil || ref.Tag == "" {
+				continue
+			}
+			for _, r := range refs {
+				if r.ref.Registry == ref.Registry && r.ref.Repository == ref.Repository && r.ref.Tag == ref.Tag {
+					var target string
+					if target, err = rw.Target(r.image); err != nil {
+						return
+					}
+					set(append(append([]string{}, p...), k), target, r.image)
+				}
+			}
+		}
+
+		// images given as registry and repository
+		repoKey := "repository"
+		repo, ok := m[repoKey].(string)
+		if !ok {
+			repoKey = "image"
+			if repo, ok = m[repoKey].(string); !ok || strings.Contains(repo, ":") {
+				return
+			}
+		}
+		registry, hasRegistry := m["registry"].(string)
+		joined := strings.Trim(path.Join(registry, repo), "/")
+		if joined == "" {
+			return
+		}
+		for _, r := range refs {
+			prefixes, matched := matchRepo(r.variants, joined)
+			if !matched {
+				continue
+			}
+			var target, desired string
+			if target, err = rw.Repository(r.image); err != nil {
+				return
+			}
+			if len(prefixes) == 0 {
+				desired = rw.Registry() + "/" + target
+			} else {
+				// the host comes from a shared value, e.g. registryFQDN
+				key := sharedValue(leaves, prefixes)
+				if key == nil {
+					continue
+				}
+				set(key, rw.Registry(), r.image)
+				desired = target
+			}
+
+			switch {
+			case !hasRegistry:
+				set(append(append([]string{}, p...), repoKey), desired, r.image)
+			case strings.HasSuffix(desired, "/"+repo):
+				set(append(append([]string{}, p...), "registry"), strings.TrimSuffix(desired, "/"+repo), r.image)
+			case strings.Contains(desired, "/"):
+				set(append(append([]string{}, p...), "registry"), path.Dir(desired), r.image)
+				set(append(append([]string{}, p...), repoKey), path.Base(desired), r.image)
+			default:
+				// a registry value can not be empty
+				delete(resolved, r.image)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make([]ValuesOverride, 0, len(overrides))
+	for _, o := range overrides {
+		if valueAt(values, o.Path) != o.Value {
+			result = append(result, o)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].Path, ".") < strings.Join(result[j].Path, ".")
+	})
+	var unresolved []string
+	for _, r := range refs {
+		if !resolved[r.image] {
+			unresolved = append(unresolved, r.image)
+		}
+	}
+	return result, unresolved, nil
+}
+
+// OverridesToValues turns the overrides into a values tree.
+func OverridesToValues(overrides []ValuesOverride) map[string]any {
+	values := map[string]any{}
+	for _, o := range overrides {
+		m := values
+		for _, k := range o.Path[:len(o.Path)-1] {
+			child, ok := m[k].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				m[k] = child
+			}
+			m = child
+		}
+		m[o.Path[len(o.Path)-1]] = o.Value
+	}
+	return values
+}
+
+func valueAt(values map[string]any, p []string) any {
+	var v any = values
+	for _, k := range p {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// walkValues calls fn for every map in the values, depth first. Lists are
+// not entered, as a single item of a list can not be overridden.
+func walkValues(m map[string]any, p []string, fn func(p []string, m map[string]any)) {
+	fn(p, m)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if child, ok := m[k].(map[string]any); ok {
+			walkValues(child, append(append([]string{}, p...), k), fn)
+		}
+	}
+}
+
+// repoVariants returns the ways a chart may spell the repository of ref.
+func repoVariants(ref *name.Image) []string {
+	variants := []string{ref.Registry + "/" + ref.Repository}
+	if ref.Registry == gname.DefaultRegistry {
+		variants = append(variants, "docker.io/"+ref.Repository, ref.Repository)
+		if short, ok := strings.CutPrefix(ref.Repository, "library/"); ok {
+			variants = append(variants, "docker.io/"+short, short)
+		}
+	}
+	return variants
+}
+
+// matchRepo reports whether joined names the repository of the variants. If
+// joined lacks the registry host, the possible missing prefixes are returned.
+func matchRepo(variants []string, joined string) ([]string, bool) {
+	var prefixes []string
+	for _, v := range variants {
+		if v == joined {
+			return nil, true
+		}
+		if prefix, ok := strings.CutSuffix(v, "/"+joined); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, len(prefixes) > 0
+}
+
+// sharedValue returns the shortest path of a string value equal to one of
+// the prefixes.
+func sharedValue(leaves map[string][]string, prefixes []string) []string {
+	var best string
+	for _, prefix := range prefixes {
+		for _, p := range leaves[prefix] {
+			if best == "" || strings.Count(p, "\x00") < strings.Count(best, "\x00") {
+				best = p
+			}
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return strings.Split(best, "\x00")
+}
@@ -0,0 +1,131 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestAirgapOverrides(t *testing.T) {
+	tests := []struct {
+		name           string
+		values         string
+		images         []string
+		want           map[string]string
+		wantUnresolved []string
+	}{
+		{
+			name:   "single string",
+			values: "operator:\n  image: ghcr.io/appscode/foo:1.0\n",
+			images: []string{"ghcr.io/appscode/foo:1.0"},
+			want:   map[string]string{"operator.image": "mirror.example.com/airgap/appscode/foo:1.0"},
+		},
+		{
+			name:   "registry and repository",
+			values: "operator:\n  registry: ghcr.io/appscode\n  repository: foo\n  tag: \"1.0\"\n",
+			images: []string{"ghcr.io/appscode/foo:1.0"},
+			want:   map[string]string{"operator.registry": "mirror.example.com/airgap/appscode"},
+		},
+		{
+			name:   "repository with registry",
+			values: "operator:\n  repository: ghcr.io/appscode/foo\n  tag: \"1.0\"\n",
+			images: []string{"ghcr.io/appscode/foo:1.0"},
+			want:   map[string]string{"operator.repository": "mirror.example.com/airgap/appscode/foo"},
+		},
+		{
+			name:   "shared registry host",
+			values: "registryFQDN: ghcr.io\noperator:\n  registry: appscode\n  repository: foo\nwebhook:\n  registry: appscode\n  repository: bar\n",
+			images: []string{"ghcr.io/appscode/foo:1.0", "ghcr.io/appscode/bar:2.0"},
+			want:   map[string]string{"registryFQDN": "mirror.example.com/airgap"},
+		},
+		{
+			name:   "docker hub official image",
+			values: "redis:\n  image:\n    repository: redis\n    tag: \"7.2\"\n",
+			images: []string{"redis:7.2"},
+			want:   map[string]string{"redis.image.repository": "mirror.example.com/airgap/redis"},
+		},
+		{
+			name:   "docker hub image with registry key",
+			values: "redis:\n  image:\n    registry: docker.io\n    repository: bitnami/redis\n",
+			images: []string{"bitnami/redis:7.2"},
+			want:   map[string]string{"redis.image.registry": "mirror.example.com/airgap"},
+		},
+		{
+			name:   "image key with separate tag",
+			values: "agent:\n  image: ghcr.io/appscode/agent\n  tag: \"1.0\"\n",
+			images: []string{"ghcr.io/appscode/agent:1.0"},
+			want:   map[string]string{"agent.image": "mirror.example.com/airgap/appscode/agent"},
+		},
+		{
+			name:           "images without a value are unresolved",
+			values:         "operator:\n  image: ghcr.io/appscode/foo:1.0\n",
+			images:         []string{"ghcr.io/appscode/foo:2.0", "ghcr.io/appscode/bar:1.0"},
+			want:           map[string]string{},
+			wantUnresolved: []string{"ghcr.io/appscode/foo:2.0", "ghcr.io/appscode/bar:1.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var values map[string]any
+			if err := yaml.Unmarshal([]byte(tt.values), &values); err != nil {
+				t.Fatal(err)
+			}
+			rw, err := NewRewriter("mirror.example.com/airgap", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			overrides, unresolved, err := AirgapOverrides(values, tt.images, rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, o := range overrides {
+				got[strings.Join(o.Path, ".")] = o.Value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("overrides = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(unresolved, tt.wantUnresolved) {
+				t.Errorf("unresolved = %v, want %v", unresolved, tt.wantUnresolved)
+			}
+		})
+	}
+}
+
+func TestOverridesToValues(t *testing.T) {
+	got := OverridesToValues([]ValuesOverride{
+		{Path: []string{"registryFQDN"}, Value: "mirror.example.com"},
+		{Path: []string{"operator", "image", "registry"}, Value: "mirror.example.com/appscode"},
+		{Path: []string{"operator", "image", "repository"}, Value: "foo"},
+	})
+	want := map[string]any{
+		"registryFQDN": "mirror.example.com",
+		"operator": map[string]any{
+			"image": map[string]any{
+				"registry":   "mirror.example.com/appscode",
+				"repository": "foo",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("values = %v, want %v", got, want)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package lib
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -53,40 +54,76 @@ func MapImages(rootDir string, values map[string]string) (map[string]string, err
 		if !entry.IsDir() {
 			continue
 		}
-		mapChartImages(rootDir, values, sh, entry, images)
+		if err := mapChartImages(rootDir, values, sh, entry, images); err != nil {
+			return nil, err
+		}
 	}
 	return images, nil
 }
 
-func mapChartImages(rootDir string, values map[string]string, sh *shell.Session, entry os.DirEntry, images map[string]string) {
+func mapChartImages(rootDir string, values map[string]string, sh *shell.Session, entry os.DirEntry, images map[string]string) error {
 	chartName := entry.Name()
-	if !strings.HasSuffix(chartName, "-certified") &&
-		!strings.HasSuffix(chartName, "-certified-crds") {
-		err := sh.SetDir(filepath.Join(rootDir, chartName)).Command("helm", "dependency", "update").Run()
-		if err != nil {
-			panic(err)
-		}
+	if err := updateChartDependencies(sh, rootDir, chartName); err != nil {
+		return fmt.Errorf("%s: %w", chartName, err)
+	}
+	if err := renderChartImages(sh, rootDir, chartName, values[chartName], images); err != nil {
+		klog.Infof("Skipping %s due to error: %v", chartName, err)
 	}
+	return nil
+}
 
+// UpdateChartDependencies runs helm dependency update for the chart, unless
+// it is a certified chart that vendors its dependencies.
+func UpdateChartDependencies(rootDir, chartName string) error {
+	sh := shell.NewSession()
+	sh.ShowCMD = true
+	return updateChartDependencies(sh, rootDir, chartName)
+}
+
+func updateChartDependencies(sh *shell.Session, rootDir, chartName string) error {
+	if strings.HasSuffix(chartName, "-certified") ||
+		strings.HasSuffix(chartName, "-certified-crds") {
+		return nil
+	}
+	return sh.SetDir(filepath.Join(rootDir, chartName)).Command("helm", "dependency", "update").Run()
+}
+
+// ChartImages renders a single chart the way MapImages does and returns its
+// images. content is passed as values like the entries of the values map of
+// MapImages, extraValues are additional values files applied last.
+func ChartImages(rootDir, chartName, content string, extraValues ...string) (map[string]string, error) {
+	sh := shell.NewSession()
+	sh.ShowCMD = true
+
+	images := map[string]string{}
+	if err := renderChartImages(sh, rootDir, chartName, content, images, extraValues...); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// renderChartImages runs helm template for the chart and adds the images of
+// the rendered objects to images. It returns the error of helm or of parsing
+// its output.
+func renderChartImages(sh *shell.Session, rootDir, chartName, content string, images map[string]string, extraValues ...string) error {
 	args := []any{"template", chartName}
 
-	content, ok := values[chartName]
-	if ok {
+	if content != "" {
 		tmpfile, err := os.CreateTemp("", chartName+"-val-*.yaml")
 		if err != nil {
-			klog.Fatal(err)
+			return err
 		}
 		defer os.Remove(tmpfile.Name()) // nolint:errcheck
 
 		if _, err := io.WriteString(tmpfile, content); err != nil {
 			tmpfile.Close() // nolint:errcheck
-			klog.Fatal(err)
+			return err
 		}
 
 		// 4. Close the file handle
 		// We must close the file handle before attempting to read from it or before the defer os.Remove runs.
 		if err := tmpfile.Close(); err != nil {
-			klog.Fatal(err)
+			return err
 		}
 
 		args = append(args, "--values="+tmpfile.Name())
@@ -101,18 +138,23 @@ func mapChartImages(rootDir string, values map[string]string, sh *shell.Session,
 			}
 		}
 	}
-	if out, err := sh.SetDir(rootDir).Command("helm", args...).Output(); err == nil {
-		helmout, err := parser.ListResources(out)
-		if err != nil {
-			panic(err)
-		}
+	for _, file := range extraValues {
+		args = append(args, "--values="+file)
+	}
 
-		for _, ri := range helmout {
-			collectImages(ri.Object.UnstructuredContent(), images, ri.Object.GetObjectKind().GroupVersionKind().GroupKind().String())
-		}
-	} else {
-		klog.Infof("Skipping %s due to error: %v", chartName, err)
+	out, err := sh.SetDir(rootDir).Command("helm", args...).Output()
+	if err != nil {
+		return err
+	}
+	helmout, err := parser.ListResources(out)
+	if err != nil {
+		return fmt.Errorf("failed to parse helm output: %w", err)
+	}
+
+	for _, ri := range helmout {
+		collectImages(ri.Object.UnstructuredContent(), images, ri.Object.GetObjectKind().GroupVersionKind().GroupKind().String())
 	}
+	return nil
 }
 
 func collectImages(obj map[string]any, images map[string]string, srcGK string) {
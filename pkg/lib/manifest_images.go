@@ -0,0 +1,108 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RewriteImages replaces every image field of the YAML documents in data,
+// the same fields MapImages collects, with the result of fn. Only the image
+// values are changed, the rest of data, including comments and formatting,
+// is kept byte for byte.
+func RewriteImages(data []byte, fn func(img string) (string, error)) ([]byte, error) {
+	var edits []ScalarEdit
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		err := rewriteImageNodes(&doc, "", func(_ string, v *yaml.Node) error {
+			img, err := fn(v.Value)
+			if err != nil {
+				return err
+			}
+			if img != v.Value {
+				edits = append(edits, ScalarEdit{Node: v, Value: img})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ApplyScalarEdits(data, edits)
+}
+
+// RewriteNodeImages replaces the image fields below n with the result of fn.
+// fn also gets the path of the field, e.g. spec.containers[0].image.
+func RewriteNodeImages(n *yaml.Node, fn func(path, img string) (string, error)) error {
+	return rewriteImageNodes(n, "", func(path string, v *yaml.Node) error {
+		img, err := fn(path, v.Value)
+		if err != nil {
+			return err
+		}
+		v.Value = img
+		return nil
+	})
+}
+
+// rewriteImageNodes calls fn with the path and the scalar node of every image
+// field below n.
+func rewriteImageNodes(n *yaml.Node, p string, fn func(path string, v *yaml.Node) error) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			fp := k.Value
+			if p != "" {
+				fp = p + "." + k.Value
+			}
+			if k.Value == "image" && v.Kind == yaml.ScalarNode && strings.ContainsRune(v.Value, ':') {
+				if err := fn(fp, v); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := rewriteImageNodes(v, fp, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if err := rewriteImageNodes(c, fmt.Sprintf("%s[%d]", p, i), fn); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, c := range n.Content {
+			if err := rewriteImageNodes(c, p, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
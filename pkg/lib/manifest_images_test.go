@@ -0,0 +1,133 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRewriteImages(t *testing.T) {
+	mirror := func(img string) (string, error) {
+		return "mirror.example.com/" + img, nil
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "comments and formatting are kept",
+			in: `# Source: chart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: app   # main container
+        image: "appscode/foo:1.0"
+        args: [--a,   --b]
+      initContainers:
+      - image: 'appscode/bar:2.0'
+`,
+			want: `# Source: chart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: app   # main container
+        image: "mirror.example.com/appscode/foo:1.0"
+        args: [--a,   --b]
+      initContainers:
+      - image: 'mirror.example.com/appscode/bar:2.0'
+`,
+		},
+		{
+			name: "documents without images are not touched",
+			in: `# Source: chart/templates/configmap.yaml
+kind: ConfigMap
+data:
+  script: |
+    echo   "image: appscode/foo:1.0"
+---
+# Source: chart/templates/empty.yaml
+---
+kind: Pod
+spec:
+  containers:
+  - image: appscode/foo:1.0
+`,
+			want: `# Source: chart/templates/configmap.yaml
+kind: ConfigMap
+data:
+  script: |
+    echo   "image: appscode/foo:1.0"
+---
+# Source: chart/templates/empty.yaml
+---
+kind: Pod
+spec:
+  containers:
+  - image: mirror.example.com/appscode/foo:1.0
+`,
+		},
+		{
+			name: "values without a tag are not images",
+			in:   "spec:\n  image: foo\n",
+			want: "spec:\n  image: foo\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RewriteImages([]byte(tt.in), mirror)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteNodeImagesPaths(t *testing.T) {
+	var doc yaml.Node
+	in := "spec:\n  containers:\n  - image: appscode/foo:1.0\n  - image: appscode/bar:2.0\n"
+	if err := yaml.Unmarshal([]byte(in), &doc); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err := RewriteNodeImages(&doc, func(path, img string) (string, error) {
+		paths = append(paths, path)
+		return "mirror.example.com/" + img, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"spec.containers[0].image", "spec.containers[1].image"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+	if got := doc.Content[0].Content[1].Content[1].Content[0].Content[1].Value; got != "mirror.example.com/appscode/foo:1.0" {
+		t.Errorf("image = %s, want it moved to the mirror", got)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// MirrorExpectation is what an image is expected to look like in the mirror.
+type MirrorExpectation struct {
+	Source    string
+	Digest    string
+	Platforms []string
+	// Error is set if the source image could not be read.
+	Error string
+}
+
+type MirrorResult struct {
+	Source string
+	Target string
+	// Expected and Actual are the digests of the source and the target image.
+	Expected         string
+	Actual           string
+	MissingPlatforms []string
+	// Problem is empty if the target matches the source.
+	Problem string
+}
+
+func (r MirrorResult) OK() bool {
+	return r.Problem == ""
+}
+
+// ExpectFromRegistry reads the digest and platforms of each image from its
+// source registry. An image that can not be read is returned with its Error
+// set, so that one unreachable source does not stop the verification of the
+// others.
+func ExpectFromRegistry(images []string, opts BundleOptions) ([]MirrorExpectation, error) {
+	result := make([]MirrorExpectation, 0, len(images))
+	for _, img := range images {
+		e := MirrorExpectation{Source: img}
+		if err := expectFromRegistry(&e, opts); err != nil {
+			e.Error = err.Error()
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+func expectFromRegistry(e *MirrorExpectation, opts BundleOptions) error {
+	ref, err := name.ParseReference(e.Source, opts.nameOptions()...)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(ref, opts.remoteOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to fetch source: %w", err)
+	}
+	e.Digest = desc.Digest.String()
+	e.Platforms, err = descriptorPlatforms(desc)
+	if err != nil {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+	return nil
+}
+
+// ExpectFromBundle reads the digest and platforms of each image from a bundle,
+// so that a mirror can be verified without access to the source registries.
+func ExpectFromBundle(fsys fs.FS, mf *BundleManifest) ([]MirrorExpectation, error) {
+	ii, err := layoutIndex(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MirrorExpectation, 0, len(mf.Images))
+	for _, img := range mf.Images {
+		if img.Unchanged {
+			// the manifest is not in a delta bundle, only the digest is checked
+			result = append(result, MirrorExpectation{Source: img.Ref, Digest: img.Digest})
+			continue
+		}
+		h, err := v1.NewHash(img.Digest)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := ii.findDescriptor(h)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", img.Ref, err)
+		}
+		var platforms []string
+		if desc.MediaType.IsIndex() {
+			idx, err := ii.ImageIndex(h)
+			if err != nil {
+				return nil, err
+			}
+			platforms, err = indexPlatforms(idx)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			image, err := ii.Image(h)
+			if err != nil {
+				return nil, err
+			}
+			platforms, err = imagePlatforms(image)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, MirrorExpectation{
+			Source:    img.Ref,
+			Digest:    img.Digest,
+			Platforms: platforms,
+		})
+	}
+	return result, nil
+}
+
+// VerifyMirror checks that every expected image exists in the mirror with the
+// same digest and that the manifest of every expected platform can be pulled
+// from it. A registry may hold an index without all of its platform
+// manifests, so the platforms are checked even if the digest matches. An
+// image that fails is reported in its result and the others are still checked.
+func VerifyMirror(expected []MirrorExpectation, rw *Rewriter, opts BundleOptions) ([]MirrorResult, error) {
+	results := make([]MirrorResult, 0, len(expected))
+	for _, e := range expected {
+		res := MirrorResult{
+			Source:   e.Source,
+			Expected: e.Digest,
+		}
+		if err := verifyMirrorImage(&res, e, rw, opts); err != nil {
+			res.Problem = err.Error()
+		}
+		if e.Error != "" {
+			res.Problem = strings.TrimPrefix(res.Problem+", "+e.Error, ", ")
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func verifyMirrorImage(res *MirrorResult, e MirrorExpectation, rw *Rewriter, opts BundleOptions) error {
+	target, err := rw.Target(e.Source)
+	if err != nil {
+		return err
+	}
+	res.Target = target
+
+	ref, err := name.ParseReference(target, opts.nameOptions()...)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(ref, opts.remoteOptions()...)
+	if err != nil {
+		if ImageNotFound(err) {
+			res.Problem = "missing"
+			return nil
+		}
+		return err
+	}
+	res.Actual = desc.Digest.String()
+	if e.Error != "" {
+		return nil
+	}
+
+	platforms, err := pullablePlatforms(ref.Context(), desc, opts)
+	if err != nil {
+		return err
+	}
+	res.MissingPlatforms = sets.List(sets.New(e.Platforms...).Difference(sets.New(platforms...)))
+	switch {
+	case len(res.MissingPlatforms) > 0:
+		res.Problem = "missing platforms " + strings.Join(res.MissingPlatforms, ", ")
+	case res.Actual != res.Expected:
+		res.Problem = "digest mismatch"
+	}
+	return nil
+}
+
+// pullablePlatforms lists the platforms of desc whose manifest exists in repo.
+func pullablePlatforms(repo name.Repository, desc *remote.Descriptor, opts BundleOptions) ([]string, error) {
+	if !desc.MediaType.IsIndex() {
+		return descriptorPlatforms(desc)
+	}
+	mf, err := v1.ParseIndexManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, err
+	}
+	platforms := sets.New[string]()
+	for _, child := range mf.Manifests {
+		if child.Platform == nil || child.Platform.OS == "unknown" {
+			continue
+		}
+		if _, err := remote.Head(repo.Digest(child.Digest.String()), opts.remoteOptions()...); err != nil {
+			if ImageNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		platforms.Insert(child.Platform.String())
+	}
+	return sets.List(platforms), nil
+}
+
+// PlatformDigests returns the manifest and config digest of every platform
+// image of ref. Tools that save a single platform into a tarball, or re-encode
+// its manifest on push, leave one of these in the registry instead of the
+// digest of ref itself.
+func PlatformDigests(ref string, opts BundleOptions) ([]string, error) {
+	r, err := name.ParseReference(ref, opts.nameOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(r, opts.remoteOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", ref, err)
+	}
+	digests := sets.New[string]()
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		err = indexPlatformDigests(idx, digests)
+		return sets.List(digests), err
+	}
+	image, err := desc.Image()
+	if err != nil {
+		return nil, err
+	}
+	err = imagePlatformDigests(image, digests)
+	return sets.List(digests), err
+}
+
+func indexPlatformDigests(idx v1.ImageIndex, digests sets.Set[string]) error {
+	mf, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range mf.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := indexPlatformDigests(child, digests); err != nil {
+				return err
+			}
+			continue
+		}
+		image, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := imagePlatformDigests(image, digests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func imagePlatformDigests(image v1.Image, digests sets.Set[string]) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return err
+	}
+	config, err := image.ConfigName()
+	if err != nil {
+		return err
+	}
+	digests.Insert(digest.String(), config.String())
+	return nil
+}
+
+func descriptorPlatforms(desc *remote.Descriptor) ([]string, error) {
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		return indexPlatforms(idx)
+	}
+	image, err := desc.Image()
+	if err != nil {
+		return nil, err
+	}
+	return imagePlatforms(image)
+}
+
+// indexPlatforms lists the platforms of an index. Attestation manifests,
+// which use the platform unknown/unknown, are not counted.
+func indexPlatforms(idx v1.ImageIndex) ([]string, error) {
+	mf, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	platforms := sets.New[string]()
+	for _, desc := range mf.Manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		platforms.Insert(desc.Platform.String())
+	}
+	return sets.List(platforms), nil
+}
+
+func imagePlatforms(image v1.Image) ([]string, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if p := cfg.Platform(); p != nil {
+		return []string{p.String()}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"sort"
+	"strings"
+
+	"kmodules.xyz/go-containerregistry/name"
+
+	gname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistryMirror describes where the repositories of one source registry are
+// found in the mirror registry.
+type RegistryMirror struct {
+	// Registry is the source registry as container runtimes name it, e.g.
+	// docker.io rather than index.docker.io.
+	Registry string
+	// Host is the host (and port) of the mirror registry.
+	Host string
+	// Prefix is the path the repositories are placed under in the mirror.
+	// If Uniform is false, it is the path of the target registry and only
+	// the repositories with Target == Prefix + "/" + Source follow it.
+	Prefix  string
+	Uniform bool
+	// Repositories are sorted by Source.
+	Repositories []RepositoryMirror
+}
+
+type RepositoryMirror struct {
+	// Source is the repository path in the source registry, e.g. library/nginx.
+	Source string
+	// Target is the repository path in the mirror, without the host.
+	Target string
+}
+
+// Follows reports whether the repository is found under the mirror prefix
+// with its source path.
+func (m RegistryMirror) Follows(r RepositoryMirror) bool {
+	return r.Target == joinRepo(m.Prefix, r.Source)
+}
+
+// Scopes returns the coarsest source to mirror mappings that cover all
+// repositories: the whole registry if it is uniform, otherwise one scope per
+// namespace whose repositories share a target path, and single repositories
+// for the rest. Source "" stands for the whole registry.
+func (m RegistryMirror) Scopes() []RepositoryMirror {
+	if m.Uniform {
+		return []RepositoryMirror{{Source: "", Target: m.Prefix}}
+	}
+
+	var namespaces []string
+	groups := map[string][]RepositoryMirror{}
+	for _, r := range m.Repositories {
+		ns, _, ok := strings.Cut(r.Source, "/")
+		if !ok {
+			ns = r.Source
+		}
+		if _, found := groups[ns]; !found {
+			namespaces = append(namespaces, ns)
+		}
+		groups[ns] = append(groups[ns], r)
+	}
+
+	var result []RepositoryMirror
+	for _, ns := range namespaces {
+		repos := groups[ns]
+		if target, ok := namespaceTarget(ns, repos); ok {
+			result = append(result, RepositoryMirror{Source: ns, Target: target})
+			continue
+		}
+		result = append(result, repos...)
+	}
+	return result
+}
+
+// namespaceTarget returns the path that replaces ns in the targets of all
+// repos, if there is one.
+func namespaceTarget(ns string, repos []RepositoryMirror) (string, bool) {
+	var target string
+	for i, r := range repos {
+		rest, ok := strings.CutPrefix(r.Source, ns+"/")
+		if !ok {
+			return "", false
+		}
+		t, ok := strings.CutSuffix(r.Target, "/"+rest)
+		if r.Target == rest {
+			t, ok = "", true
+		}
+		if !ok || (i > 0 && t != target) {
+			return "", false
+		}
+		target = t
+	}
+	return target, true
+}
+
+// MirrorRegistries groups the images by source registry and maps each
+// repository to its path in the mirror. A registry is uniform if all of its
+// repositories keep their path under a common prefix, which is all that
+// runtimes without repository rewriting can express.
+func MirrorRegistries(images []string, rw *Rewriter) ([]RegistryMirror, error) {
+	host, basePath, _ := strings.Cut(rw.Registry(), "/")
+
+	repos := map[string]map[string]string{}
+	for _, img := range images {
+		ref, err := name.ParseReference(img)
+		if err != nil {
+			return nil, err
+		}
+		target, err := rw.Repository(img)
+		if err != nil {
+			return nil, err
+		}
+		registry := runtimeRegistryName(ref.Registry)
+		if repos[registry] == nil {
+			repos[registry] = map[string]string{}
+		}
+		repos[registry][ref.Repository] = joinRepo(basePath, target)
+	}
+
+	result := make([]RegistryMirror, 0, len(repos))
+	for registry, m := range repos {
+		rm := RegistryMirror{Registry: registry, Host: host, Uniform: true}
+		for src, target := range m {
+			rm.Repositories = append(rm.Repositories, RepositoryMirror{Source: src, Target: target})
+		}
+		sort.Slice(rm.Repositories, func(i, j int) bool {
+			return rm.Repositories[i].Source < rm.Repositories[j].Source
+		})
+
+		for i, r := range rm.Repositories {
+			prefix, ok := repoPrefix(r)
+			if !ok || (i > 0 && prefix != rm.Prefix) {
+				rm.Uniform = false
+				break
+			}
+			rm.Prefix = prefix
+		}
+		if !rm.Uniform {
+			rm.Prefix = basePath
+		}
+		result = append(result, rm)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Registry < result[j].Registry })
+	return result, nil
+}
+
+// repoPrefix returns the path the target adds in front of the source path.
+func repoPrefix(r RepositoryMirror) (string, bool) {
+	if r.Target == r.Source {
+		return "", true
+	}
+	prefix, ok := strings.CutSuffix(r.Target, "/"+r.Source)
+	return prefix, ok
+}
+
+func joinRepo(prefix, repo string) string {
+	if prefix == "" {
+		return repo
+	}
+	return prefix + "/" + repo
+}
+
+func runtimeRegistryName(registry string) string {
+	if registry == gname.DefaultRegistry {
+		return "docker.io"
+	}
+	return registry
+}
@@ -0,0 +1,158 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMirrorRegistries(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []RewriteRule
+		images []string
+		want   []RegistryMirror
+	}{
+		{
+			name:   "source paths are kept",
+			rules:  []RewriteRule{},
+			images: []string{"nginx:1.25", "ghcr.io/appscode/foo:1.0", "ghcr.io/kubedb/bar:2.0"},
+			want: []RegistryMirror{
+				{
+					Registry: "docker.io", Host: "mirror.example.com", Prefix: "airgap", Uniform: true,
+					Repositories: []RepositoryMirror{{Source: "library/nginx", Target: "airgap/library/nginx"}},
+				},
+				{
+					Registry: "ghcr.io", Host: "mirror.example.com", Prefix: "airgap", Uniform: true,
+					Repositories: []RepositoryMirror{
+						{Source: "appscode/foo", Target: "airgap/appscode/foo"},
+						{Source: "kubedb/bar", Target: "airgap/kubedb/bar"},
+					},
+				},
+			},
+		},
+		{
+			name:   "official images break the default rules",
+			images: []string{"nginx:1.25", "bitnami/redis:7.2"},
+			want: []RegistryMirror{
+				{
+					Registry: "docker.io", Host: "mirror.example.com", Prefix: "airgap",
+					Repositories: []RepositoryMirror{
+						{Source: "bitnami/redis", Target: "airgap/bitnami/redis"},
+						{Source: "library/nginx", Target: "airgap/nginx"},
+					},
+				},
+			},
+		},
+		{
+			name:   "registry prefix",
+			rules:  []RewriteRule{{Type: RewriteAddPrefix, Prefix: "k8s", Registry: "registry.k8s.io"}},
+			images: []string{"registry.k8s.io/pause:3.9", "registry.k8s.io/sig-storage/livenessprobe:v2.12.0"},
+			want: []RegistryMirror{
+				{
+					Registry: "registry.k8s.io", Host: "mirror.example.com", Prefix: "airgap/k8s", Uniform: true,
+					Repositories: []RepositoryMirror{
+						{Source: "pause", Target: "airgap/k8s/pause"},
+						{Source: "sig-storage/livenessprobe", Target: "airgap/k8s/sig-storage/livenessprobe"},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg *RewriteConfig
+			if tt.rules != nil {
+				cfg = &RewriteConfig{Rules: tt.rules}
+			}
+			rw, err := NewRewriter("mirror.example.com/airgap", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := MirrorRegistries(tt.images, rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mirrors = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryMirrorScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		mirror RegistryMirror
+		want   []RepositoryMirror
+	}{
+		{
+			name:   "uniform registry",
+			mirror: RegistryMirror{Prefix: "airgap", Uniform: true},
+			want:   []RepositoryMirror{{Source: "", Target: "airgap"}},
+		},
+		{
+			name: "namespaces with a common target",
+			mirror: RegistryMirror{
+				Prefix: "airgap",
+				Repositories: []RepositoryMirror{
+					{Source: "appscode/bar", Target: "airgap/appscode/bar"},
+					{Source: "appscode/foo", Target: "airgap/appscode/foo"},
+					{Source: "kubedb/operator", Target: "airgap/db/operator"},
+				},
+			},
+			want: []RepositoryMirror{
+				{Source: "appscode", Target: "airgap/appscode"},
+				{Source: "kubedb", Target: "airgap/db"},
+			},
+		},
+		{
+			name: "namespace moved to the root",
+			mirror: RegistryMirror{
+				Repositories: []RepositoryMirror{
+					{Source: "library/nginx", Target: "nginx"},
+					{Source: "library/redis", Target: "redis"},
+				},
+			},
+			want: []RepositoryMirror{{Source: "library", Target: ""}},
+		},
+		{
+			name: "flattened repositories are listed one by one",
+			mirror: RegistryMirror{
+				Prefix: "airgap",
+				Repositories: []RepositoryMirror{
+					{Source: "fluxcd/helm-controller", Target: "airgap/flux-helm-controller"},
+					{Source: "fluxcd/source-controller", Target: "airgap/source-controller"},
+					{Source: "pause", Target: "airgap/pause"},
+				},
+			},
+			want: []RepositoryMirror{
+				{Source: "fluxcd/helm-controller", Target: "airgap/flux-helm-controller"},
+				{Source: "fluxcd/source-controller", Target: "airgap/source-controller"},
+				{Source: "pause", Target: "airgap/pause"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mirror.Scopes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scopes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// PruneCandidate is a manifest in the mirror that no retained or protected
+// tag points to. Registries delete manifests by digest, so all its tags go
+// with it.
+type PruneCandidate struct {
+	Repository string
+	Digest     string
+	Tags       []string
+}
+
+type PrunePlan struct {
+	Candidates []PruneCandidate
+	// Kept is the number of tags that stay in the mirror.
+	Kept int
+}
+
+// PlanPrune lists the repositories under the registry prefix of rw and finds
+// the manifests that are not the target of any retained image. Tags matching
+// one of the protect globs are kept. The globs use path.Match syntax and are
+// matched against "repository:tag" relative to the prefix, e.g. "appscode/*:*".
+// Retained images pinned by digest keep that digest. Artifacts attached to a
+// kept manifest, by cosign tag or through the referrers API, are kept too.
+func PlanPrune(retained []string, rw *Rewriter, protect []string, opts BundleOptions) (*PrunePlan, error) {
+	for _, glob := range protect {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid protect glob %q: %w", glob, err)
+		}
+	}
+	// an empty list would make every manifest under the prefix a candidate
+	if len(retained) == 0 {
+		return nil, errors.New("no images to keep, refusing to prune the whole registry")
+	}
+	keep, err := retainedTargets(retained, rw, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	host, prefix, _ := strings.Cut(rw.Registry(), "/")
+	reg, err := name.NewRegistry(host, opts.nameOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := remote.Catalog(context.Background(), reg, opts.remoteOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories of %s: %w", host, err)
+	}
+
+	var repos []mirrorRepository
+	for _, r := range catalog {
+		rel := r
+		if prefix != "" {
+			var ok bool
+			if rel, ok = strings.CutPrefix(r, prefix+"/"); !ok {
+				continue
+			}
+		}
+		repo := reg.Repo(r)
+		tags, err := remote.List(repo, opts.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", repo, err)
+		}
+		mr := mirrorRepository{
+			Name: repo.String(),
+			Rel:  rel,
+			Tags: make(map[string]string, len(tags)),
+		}
+		for _, tag := range tags {
+			desc, err := remote.Head(repo.Tag(tag), opts.remoteOptions()...)
+			if err != nil {
+				return nil, err
+			}
+			mr.Tags[tag] = desc.Digest.String()
+		}
+		repos = append(repos, mr)
+	}
+
+	return planPrune(repos, keep, protect, func(repo, digest string) ([]string, error) {
+		ref, err := name.NewDigest(repo+"@"+digest, opts.nameOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		artifacts, err := ImageArtifacts(ref, opts.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list artifacts of %s: %w", ref, err)
+		}
+		digests := make([]string, 0, len(artifacts))
+		for _, a := range artifacts {
+			digests = append(digests, a.Descriptor.Digest.String())
+		}
+		return digests, nil
+	})
+}
+
+// mirrorRepository is a repository of the mirror and the digest of each tag.
+type mirrorRepository struct {
+	// Name is the full repository name, Rel the name relative to the prefix.
+	Name string
+	Rel  string
+	Tags map[string]string
+}
+
+// retainedSet holds the mirror names of the retained images.
+type retainedSet struct {
+	// tags holds full tag names, e.g. registry/appscode/foo:1.0.
+	tags sets.Set[string]
+	// digests maps full repository names to the digests pinned in them.
+	digests map[string]sets.Set[string]
+}
+
+func retainedTargets(retained []string, rw *Rewriter, opts BundleOptions) (*retainedSet, error) {
+	keep := &retainedSet{
+		tags:    sets.New[string](),
+		digests: map[string]sets.Set[string]{},
+	}
+	for _, img := range retained {
+		repo, err := rw.Repository(img)
+		if err != nil {
+			return nil, err
+		}
+		r, err := name.NewRepository(rw.Registry()+"/"+repo, opts.nameOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		tag, digest := imageTagDigest(img)
+		if tag == "" && digest == "" {
+			return nil, fmt.Errorf("image %s has neither tag nor digest", img)
+		}
+		if tag != "" {
+			keep.tags.Insert(r.Tag(tag).Name())
+		}
+		if digest != "" {
+			if keep.digests[r.String()] == nil {
+				keep.digests[r.String()] = sets.New[string]()
+			}
+			keep.digests[r.String()].Insert(digest)
+		}
+	}
+	return keep, nil
+}
+
+// imageTagDigest returns the tag and digest of an image reference, either
+// may be empty.
+func imageTagDigest(img string) (tag, digest string) {
+	img, digest, _ = strings.Cut(img, "@")
+	if idx := strings.LastIndex(img, ":"); idx > strings.LastIndex(img, "/") {
+		tag = img[idx+1:]
+	}
+	return tag, digest
+}
+
+// cosignTag matches the tags cosign attaches artifacts with and the tag of the
+// referrers tag schema, sha256-<hex>[.sig|.att|.sbom].
+var cosignTag = regexp.MustCompile(`^(sha256)-([0-9a-f]{64})(\.[a-z]+)?$`)
+
+// planPrune finds the manifests of repos that are neither retained, protected
+// nor attached to a kept manifest. artifacts returns the digests of the
+// artifacts attached to a manifest.
+func planPrune(repos []mirrorRepository, keep *retainedSet, protect []string, artifacts func(repo, digest string) ([]string, error)) (*PrunePlan, error) {
+	var plan PrunePlan
+	for _, repo := range repos {
+		inUse := sets.New[string]()
+		if d, ok := keep.digests[repo.Name]; ok {
+			inUse.Insert(sets.List(d)...)
+		}
+		for tag, d := range repo.Tags {
+			if keep.tags.Has(repo.Name+":"+tag) || protected(protect, repo.Rel+":"+tag) {
+				inUse.Insert(d)
+			}
+		}
+
+		// keep the artifacts of kept manifests, and theirs in turn
+		queue := sets.List(inUse)
+		for len(queue) > 0 {
+			d := queue[0]
+			queue = queue[1:]
+			attached, err := artifacts(repo.Name, d)
+			if err != nil {
+				return nil, err
+			}
+			for tag, td := range repo.Tags {
+				if m := cosignTag.FindStringSubmatch(tag); m != nil && m[1]+":"+m[2] == d {
+					attached = append(attached, td)
+				}
+			}
+			for _, a := range attached {
+				if !inUse.Has(a) {
+					inUse.Insert(a)
+					queue = append(queue, a)
+				}
+			}
+		}
+
+		digests := map[string][]string{}
+		for tag, d := range repo.Tags {
+			if inUse.Has(d) {
+				plan.Kept++
+				continue
+			}
+			digests[d] = append(digests[d], tag)
+		}
+		for d, tags := range digests {
+			sort.Strings(tags)
+			plan.Candidates = append(plan.Candidates, PruneCandidate{
+				Repository: repo.Name,
+				Digest:     d,
+				Tags:       tags,
+			})
+		}
+	}
+	sort.Slice(plan.Candidates, func(i, j int) bool {
+		a, b := plan.Candidates[i], plan.Candidates[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.Tags[0] < b.Tags[0]
+	})
+	return &plan, nil
+}
+
+func protected(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune deletes the manifests of the candidates. It carries on after a failed
+// delete and returns all errors.
+func Prune(candidates []PruneCandidate, opts BundleOptions) error {
+	var errs []error
+	for _, c := range candidates {
+		ref, err := name.NewDigest(c.Repository+"@"+c.Digest, opts.nameOptions()...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		klog.Infof("deleting %s (%s)", ref, strings.Join(c.Tags, ", "))
+		if err := remote.Delete(ref, opts.remoteOptions()...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete %s: %w", ref, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func testDigest(c byte) string {
+	return "sha256:" + strings.Repeat(string(c), 64)
+}
+
+func cosignTagOf(digest, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + suffix
+}
+
+func TestPlanPruneRefusesEmptyList(t *testing.T) {
+	rw, err := NewRewriter("mirror.example.com/airgap", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PlanPrune(nil, rw, nil, BundleOptions{}); err == nil {
+		t.Fatal("expected an error for an empty list of images to keep")
+	}
+}
+
+func TestRetainedTargets(t *testing.T) {
+	rw, err := NewRewriter("mirror.example.com/airgap", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep, err := retainedTargets([]string{
+		"ghcr.io/appscode/foo:1.0",
+		"ghcr.io/appscode/bar@" + testDigest('a'),
+		"ghcr.io/appscode/baz:2.0@" + testDigest('b'),
+	}, rw, BundleOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTags := []string{
+		"mirror.example.com/airgap/appscode/baz:2.0",
+		"mirror.example.com/airgap/appscode/foo:1.0",
+	}
+	if got := sets.List(keep.tags); !reflect.DeepEqual(got, wantTags) {
+		t.Errorf("tags = %v, want %v", got, wantTags)
+	}
+	wantDigests := map[string][]string{
+		"mirror.example.com/airgap/appscode/bar": {testDigest('a')},
+		"mirror.example.com/airgap/appscode/baz": {testDigest('b')},
+	}
+	gotDigests := map[string][]string{}
+	for repo, d := range keep.digests {
+		gotDigests[repo] = sets.List(d)
+	}
+	if !reflect.DeepEqual(gotDigests, wantDigests) {
+		t.Errorf("digests = %v, want %v", gotDigests, wantDigests)
+	}
+
+	if _, err := retainedTargets([]string{"ghcr.io/appscode/foo"}, rw, BundleOptions{}); err == nil {
+		t.Error("expected an error for an image without tag and digest")
+	}
+}
+
+func TestPlanPrune(t *testing.T) {
+	const repo = "mirror.example.com/airgap/appscode/foo"
+	var (
+		kept     = testDigest('1')
+		stale    = testDigest('2')
+		pinned   = testDigest('3')
+		sig      = testDigest('4')
+		sigOfSig = testDigest('5')
+		referrer = testDigest('6')
+		orphan   = testDigest('7')
+	)
+
+	tests := []struct {
+		name      string
+		tags      map[string]string
+		keep      *retainedSet
+		protect   []string
+		artifacts map[string][]string
+		want      []PruneCandidate
+		wantKept  int
+	}{
+		{
+			name: "tags not in the list are deleted",
+			tags: map[string]string{"1.0": kept, "0.9": stale},
+			keep: retained([]string{repo + ":1.0"}, nil),
+			want: []PruneCandidate{
+				{Repository: repo, Digest: stale, Tags: []string{"0.9"}},
+			},
+			wantKept: 1,
+		},
+		{
+			name:     "a digest shared with a kept tag is kept",
+			tags:     map[string]string{"1.0": kept, "latest": kept},
+			keep:     retained([]string{repo + ":1.0"}, nil),
+			wantKept: 2,
+		},
+		{
+			name:     "protected tags are kept",
+			tags:     map[string]string{"1.0": kept, "0.9": stale},
+			keep:     retained([]string{repo + ":1.0"}, nil),
+			protect:  []string{"appscode/foo:0.*"},
+			wantKept: 2,
+		},
+		{
+			name: "images pinned by digest are kept",
+			tags: map[string]string{"1.0": kept, "0.9": pinned, "0.8": stale},
+			keep: retained([]string{repo + ":1.0"}, map[string][]string{repo: {pinned}}),
+			want: []PruneCandidate{
+				{Repository: repo, Digest: stale, Tags: []string{"0.8"}},
+			},
+			wantKept: 2,
+		},
+		{
+			name: "cosign tags of kept digests are kept",
+			tags: map[string]string{
+				"1.0":                       kept,
+				cosignTagOf(kept, ".sig"):   sig,
+				cosignTagOf(sig, ".att"):    sigOfSig,
+				"0.9":                       stale,
+				cosignTagOf(stale, ".sbom"): orphan,
+			},
+			keep: retained([]string{repo + ":1.0"}, nil),
+			want: []PruneCandidate{
+				{Repository: repo, Digest: stale, Tags: []string{"0.9"}},
+				{Repository: repo, Digest: orphan, Tags: []string{cosignTagOf(stale, ".sbom")}},
+			},
+			wantKept: 3,
+		},
+		{
+			name: "referrers of kept digests are kept",
+			tags: map[string]string{
+				"1.0":                 kept,
+				"attestation":         referrer,
+				cosignTagOf(kept, ""): referrer,
+			},
+			keep:      retained([]string{repo + ":1.0"}, nil),
+			artifacts: map[string][]string{kept: {referrer}},
+			wantKept:  3,
+		},
+		{
+			name: "artifacts of pinned digests are kept",
+			tags: map[string]string{
+				cosignTagOf(pinned, ".sig"): sig,
+			},
+			keep:     retained(nil, map[string][]string{repo: {pinned}}),
+			wantKept: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repos := []mirrorRepository{{Name: repo, Rel: "appscode/foo", Tags: tt.tags}}
+			plan, err := planPrune(repos, tt.keep, tt.protect, func(r, d string) ([]string, error) {
+				if r != repo {
+					t.Errorf("artifacts of unexpected repository %s", r)
+				}
+				return tt.artifacts[d], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(plan.Candidates, tt.want) {
+				t.Errorf("candidates = %v, want %v", plan.Candidates, tt.want)
+			}
+			if plan.Kept != tt.wantKept {
+				t.Errorf("kept = %d, want %d", plan.Kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func retained(tags []string, digests map[string][]string) *retainedSet {
+	keep := &retainedSet{
+		tags:    sets.New(tags...),
+		digests: map[string]sets.Set[string]{},
+	}
+	for repo, d := range digests {
+		keep.digests[repo] = sets.New(d...)
+	}
+	return keep
+}
@@ -0,0 +1,236 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"kmodules.xyz/go-containerregistry/name"
+
+	gname "github.com/google/go-containerregistry/pkg/name"
+	"sigs.k8s.io/yaml"
+)
+
+type RewriteRuleType string
+
+const (
+	RewriteStripPrefix RewriteRuleType = "stripPrefix"
+	RewriteAddPrefix   RewriteRuleType = "addPrefix"
+	RewriteRegex       RewriteRuleType = "regex"
+	RewriteFlatten     RewriteRuleType = "flatten"
+	RewriteMap         RewriteRuleType = "map"
+)
+
+// RewriteConfig decides where an image is placed in the mirror registry.
+// The rules are applied in order to the repository path of the source image
+// (e.g. "library/nginx" or "appscode/cluster-ui"); the result is appended to
+// the target registry.
+//
+//	rules:
+//	- type: stripPrefix
+//	  prefix: library/
+//	- type: addPrefix
+//	  registry: ghcr.io
+//	  prefix: ghcr/
+//	- type: map
+//	  map:
+//	    fluxcd/helm-controller: flux-helm-controller
+//	- type: regex
+//	  pattern: ^kubedb/(.*)$
+//	  replacement: db/$1
+//	- type: flatten
+//	  separator: "-"
+type RewriteConfig struct {
+	Rules []RewriteRule `json:"rules"`
+}
+
+type RewriteRule struct {
+	Type RewriteRuleType `json:"type"`
+	// Registry limits the rule to images from this source registry.
+	Registry string `json:"registry,omitempty"`
+	// Prefix is used by stripPrefix and addPrefix.
+	Prefix string `json:"prefix,omitempty"`
+	// Pattern and Replacement are used by regex, see regexp.Regexp.ReplaceAllString.
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	// Separator is used by flatten to join the path elements. If empty, only
+	// the last path element is kept.
+	Separator string `json:"separator,omitempty"`
+	// Map is used by map to replace a repository path with another.
+	Map map[string]string `json:"map,omitempty"`
+}
+
+// DefaultRewriteConfig places every image under the target registry with its
+// source repository path. Docker Hub official images lose their "library/" prefix.
+func DefaultRewriteConfig() *RewriteConfig {
+	return &RewriteConfig{
+		Rules: []RewriteRule{
+			{Type: RewriteStripPrefix, Prefix: "library/"},
+		},
+	}
+}
+
+// LoadRewriteConfig reads rewrite rules from a YAML file. If filename is
+// empty, the default rules are returned.
+func LoadRewriteConfig(filename string) (*RewriteConfig, error) {
+	if filename == "" {
+		return DefaultRewriteConfig(), nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseRewriteConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rewrite config %s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// ParseRewriteConfig parses rewrite rules in the format of LoadRewriteConfig.
+func ParseRewriteConfig(data []byte) (*RewriteConfig, error) {
+	var cfg RewriteConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+type Rewriter struct {
+	registry string
+	rules    []rewriteRule
+}
+
+type rewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp
+}
+
+// NewRewriter returns a Rewriter that places images under registry, which
+// may also be a shell variable like "$IMAGE_REGISTRY" for generated scripts.
+func NewRewriter(registry string, cfg *RewriteConfig) (*Rewriter, error) {
+	if cfg == nil {
+		cfg = DefaultRewriteConfig()
+	}
+	r := &Rewriter{
+		registry: strings.TrimSuffix(registry, "/"),
+		rules:    make([]rewriteRule, 0, len(cfg.Rules)),
+	}
+	for i, rule := range cfg.Rules {
+		compiled := rewriteRule{RewriteRule: rule}
+		if rule.Registry != "" {
+			compiled.Registry = normalizeRegistry(rule.Registry)
+		}
+		switch rule.Type {
+		case RewriteStripPrefix, RewriteAddPrefix:
+			if rule.Prefix == "" {
+				return nil, fmt.Errorf("rule %d: %s requires a prefix", i, rule.Type)
+			}
+		case RewriteRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			compiled.re = re
+		case RewriteMap:
+			if len(rule.Map) == 0 {
+				return nil, fmt.Errorf("rule %d: map requires at least one entry", i)
+			}
+		case RewriteFlatten:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown rule type %q", i, rule.Type)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+func (r *Rewriter) Registry() string {
+	return r.registry
+}
+
+// Repository returns the repository path of img in the target registry.
+func (r *Rewriter) Repository(img string) (string, error) {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return "", err
+	}
+	return r.rewrite(ref.Registry, ref.Repository)
+}
+
+// Target returns the tagged name of img in the target registry.
+func (r *Rewriter) Target(img string) (string, error) {
+	ref, err := name.ParseReference(img)
+	if err != nil {
+		return "", err
+	}
+	if ref.Tag == "" {
+		return "", fmt.Errorf("image %s has no tag", img)
+	}
+	repo, err := r.rewrite(ref.Registry, ref.Repository)
+	if err != nil {
+		return "", err
+	}
+	return r.registry + "/" + repo + ":" + ref.Tag, nil
+}
+
+func (r *Rewriter) rewrite(registry, src string) (string, error) {
+	registry = normalizeRegistry(registry)
+	repo := src
+	for _, rule := range r.rules {
+		if rule.Registry != "" && rule.Registry != registry {
+			continue
+		}
+		switch rule.Type {
+		case RewriteStripPrefix:
+			repo = strings.TrimPrefix(repo, rule.Prefix)
+		case RewriteAddPrefix:
+			repo = path.Join(rule.Prefix, repo)
+		case RewriteRegex:
+			repo = rule.re.ReplaceAllString(repo, rule.Replacement)
+		case RewriteFlatten:
+			if rule.Separator == "" {
+				_, repo = path.Split(repo)
+			} else {
+				repo = strings.ReplaceAll(repo, "/", rule.Separator)
+			}
+		case RewriteMap:
+			if v, found := rule.Map[repo]; found {
+				repo = v
+			}
+		}
+	}
+
+	repo = strings.Trim(repo, "/")
+	if repo == "" {
+		return "", fmt.Errorf("rewrite rules produced an empty repository for %s/%s", registry, src)
+	}
+	return repo, nil
+}
+
+// normalizeRegistry maps the Docker Hub aliases to the name used by
+// go-containerregistry.
+func normalizeRegistry(registry string) string {
+	if registry == "docker.io" {
+		return gname.DefaultRegistry
+	}
+	return registry
+}
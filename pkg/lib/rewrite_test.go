@@ -0,0 +1,175 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRewriteConfig writes config to a file for LoadRewriteConfig. An empty
+// config is not written, so that the default rules are loaded.
+func writeRewriteConfig(t *testing.T, config string) string {
+	t.Helper()
+	if config == "" {
+		return ""
+	}
+	filename := filepath.Join(t.TempDir(), "rewrite.yaml")
+	if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestRewriterTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		img     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default rules strip library",
+			img:  "nginx:1.25",
+			want: "mirror.example.com/airgap/nginx:1.25",
+		},
+		{
+			name: "default rules keep other paths",
+			img:  "ghcr.io/appscode/cluster-ui:0.9.7",
+			want: "mirror.example.com/airgap/appscode/cluster-ui:0.9.7",
+		},
+		{
+			name:   "no rules",
+			config: "rules: []",
+			img:    "nginx:1.25",
+			want:   "mirror.example.com/airgap/library/nginx:1.25",
+		},
+		{
+			name:   "add prefix for one registry",
+			config: "rules:\n- type: addPrefix\n  registry: ghcr.io\n  prefix: ghcr\n",
+			img:    "ghcr.io/appscode/cluster-ui:0.9.7",
+			want:   "mirror.example.com/airgap/ghcr/appscode/cluster-ui:0.9.7",
+		},
+		{
+			name:   "rules of other registries are skipped",
+			config: "rules:\n- type: addPrefix\n  registry: ghcr.io\n  prefix: ghcr\n",
+			img:    "quay.io/prometheus/node-exporter:v1.8.0",
+			want:   "mirror.example.com/airgap/prometheus/node-exporter:v1.8.0",
+		},
+		{
+			name:   "docker.io matches Docker Hub images",
+			config: "rules:\n- type: addPrefix\n  registry: docker.io\n  prefix: hub\n",
+			img:    "bitnami/redis:7.2",
+			want:   "mirror.example.com/airgap/hub/bitnami/redis:7.2",
+		},
+		{
+			name:   "regex",
+			config: "rules:\n- type: regex\n  pattern: ^kubedb/(.*)$\n  replacement: db/$1\n",
+			img:    "ghcr.io/kubedb/operator:v0.40.0",
+			want:   "mirror.example.com/airgap/db/operator:v0.40.0",
+		},
+		{
+			name:   "map",
+			config: "rules:\n- type: map\n  map:\n    fluxcd/helm-controller: flux-helm-controller\n",
+			img:    "ghcr.io/fluxcd/helm-controller:v1.0.1",
+			want:   "mirror.example.com/airgap/flux-helm-controller:v1.0.1",
+		},
+		{
+			name:   "flatten keeps the last element",
+			config: "rules:\n- type: flatten\n",
+			img:    "registry.k8s.io/sig-storage/livenessprobe:v2.12.0",
+			want:   "mirror.example.com/airgap/livenessprobe:v2.12.0",
+		},
+		{
+			name:   "flatten with separator",
+			config: "rules:\n- type: flatten\n  separator: \"-\"\n",
+			img:    "registry.k8s.io/sig-storage/livenessprobe:v2.12.0",
+			want:   "mirror.example.com/airgap/sig-storage-livenessprobe:v2.12.0",
+		},
+		{
+			name:   "rules are applied in order",
+			config: "rules:\n- type: map\n  map:\n    appscode/foo: bar\n- type: addPrefix\n  prefix: x\n",
+			img:    "ghcr.io/appscode/foo:1.0",
+			want:   "mirror.example.com/airgap/x/bar:1.0",
+		},
+		{
+			name:    "empty result",
+			config:  "rules:\n- type: regex\n  pattern: .*\n  replacement: \"\"\n",
+			img:     "nginx:1.25",
+			wantErr: true,
+		},
+		{
+			name: "image without tag",
+			img:  "ghcr.io/appscode/cluster-ui",
+			want: "mirror.example.com/airgap/appscode/cluster-ui:latest",
+		},
+		{
+			name:    "image with only a digest",
+			img:     "ghcr.io/appscode/cluster-ui@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadRewriteConfig(writeRewriteConfig(t, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rw, err := NewRewriter("mirror.example.com/airgap/", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := rw.Target(tt.img)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("target = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRewriterInvalidRules(t *testing.T) {
+	tests := map[string]string{
+		"unknown type":        "rules:\n- type: rename\n",
+		"prefix required":     "rules:\n- type: stripPrefix\n",
+		"invalid regex":       "rules:\n- type: regex\n  pattern: \"(\"\n",
+		"empty map":           "rules:\n- type: map\n",
+		"unknown field":       "rules:\n- type: flatten\n  sep: \"-\"\n",
+		"rules is not a list": "rules: flatten\n",
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadRewriteConfig(writeRewriteConfig(t, config))
+			if err == nil {
+				_, err = NewRewriter("mirror.example.com", cfg)
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"k8s.io/klog/v2"
+)
+
+// maxManifestSize is the largest blob served as a manifest.
+const maxManifestSize = 4 << 20
+
+// OpenLayout returns the files of a bundle, a volume set or a plain OCI image
+// layout written by another tool.
+func OpenLayout(path string) (fs.FS, error) {
+	if _, err := os.Stat(filepath.Join(path, "oci-layout")); err == nil {
+		if _, err := os.Stat(filepath.Join(path, BundleManifestFile)); err != nil {
+			return os.DirFS(path), nil
+		}
+	}
+	return OpenBundle(path)
+}
+
+// RegistryServer serves the images of an OCI image layout over the read-only
+// part of the OCI distribution API. Repositories and tags are taken from the
+// ref name annotations of the layout index, so that the images are pulled as
+// "<server>/<repository>:<tag>" with the repository rewritten by rw, the same
+// name an import into that server would give them.
+type RegistryServer struct {
+	fsys fs.FS
+	// repos maps repository to tag to manifest descriptor.
+	repos map[string]map[string]v1.Descriptor
+}
+
+var _ http.Handler = (*RegistryServer)(nil)
+
+func NewRegistryServer(fsys fs.FS, rw *Rewriter) (*RegistryServer, error) {
+	ii, err := layoutIndex(fsys)
+	if err != nil {
+		return nil, err
+	}
+	mf, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RegistryServer{fsys: fsys, repos: map[string]map[string]v1.Descriptor{}}
+	for _, desc := range mf.Manifests {
+		refName := desc.Annotations[annotationRefName]
+		if refName == "" {
+			continue
+		}
+		ref, err := name.ParseReference(refName)
+		if err != nil {
+			klog.Warningf("skipping %s: %v", refName, err)
+			continue
+		}
+		repo, err := rw.Repository(refName)
+		if err != nil {
+			return nil, err
+		}
+		if s.repos[repo] == nil {
+			s.repos[repo] = map[string]v1.Descriptor{}
+		}
+		if tag, ok := ref.(name.Tag); ok {
+			s.repos[repo][tag.TagStr()] = desc
+		}
+	}
+	return s, nil
+}
+
+// Repositories returns the names of the repositories served.
+func (s *RegistryServer) Repositories() []string {
+	repos := make([]string, 0, len(s.repos))
+	for repo := range s.repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func (s *RegistryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/" || r.URL.Path == "/v2":
+		writeJSON(w, r, struct{}{})
+	case p == "_catalog":
+		writeJSON(w, r, map[string][]string{"repositories": s.Repositories()})
+	case strings.HasSuffix(p, "/tags/list"):
+		s.serveTags(w, r, strings.TrimSuffix(p, "/tags/list"))
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		s.serveManifest(w, r, p[:i], p[i+len("/manifests/"):])
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		s.serveBlob(w, r, p[:i], p[i+len("/blobs/"):])
+	default:
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "unknown endpoint")
+	}
+}
+
+func (s *RegistryServer) serveTags(w http.ResponseWriter, r *http.Request, repo string) {
+	tags, ok := s.repos[repo]
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+	list := make([]string, 0, len(tags))
+	for tag := range tags {
+		list = append(list, tag)
+	}
+	sort.Strings(list)
+	writeJSON(w, r, map[string]any{"name": repo, "tags": list})
+}
+
+func (s *RegistryServer) serveManifest(w http.ResponseWriter, r *http.Request, repo, reference string) {
+	tags, ok := s.repos[repo]
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+
+	var h v1.Hash
+	var mediaType types.MediaType
+	if desc, ok := tags[reference]; ok {
+		h, mediaType = desc.Digest, desc.MediaType
+	} else if d, err := v1.NewHash(reference); err == nil {
+		// child manifests of an index are not in the layout index
+		h = d
+		for _, desc := range tags {
+			if desc.Digest == d {
+				mediaType = desc.MediaType
+				break
+			}
+		}
+	} else {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not found")
+		return
+	}
+
+	info, err := fs.Stat(s.fsys, blobPath(h))
+	if err != nil || info.Size() > maxManifestSize {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not found")
+		return
+	}
+	raw, err := fs.ReadFile(s.fsys, blobPath(h))
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	if mediaType == "" {
+		if mediaType = manifestMediaType(raw); mediaType == "" {
+			registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest not found")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", string(mediaType))
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.Header().Set("Docker-Content-Digest", h.String())
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(raw)
+	}
+}
+
+// manifestMediaType returns the media type of the manifest raw, or "" if raw
+// is not a manifest. The mediaType field is optional in OCI manifests, without
+// it an index is told from an image by its manifests or its config and layers.
+func manifestMediaType(raw []byte) types.MediaType {
+	var m struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		MediaType     types.MediaType   `json:"mediaType"`
+		Manifests     []json.RawMessage `json:"manifests"`
+		Config        json.RawMessage   `json:"config"`
+		Layers        []json.RawMessage `json:"layers"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil || m.SchemaVersion != 2 {
+		return ""
+	}
+	switch {
+	case m.MediaType != "":
+		return m.MediaType
+	case m.Manifests != nil:
+		return types.OCIImageIndex
+	case m.Config != nil || m.Layers != nil:
+		return types.OCIManifestSchema1
+	}
+	return ""
+}
+
+func (s *RegistryServer) serveBlob(w http.ResponseWriter, r *http.Request, repo, digest string) {
+	if _, ok := s.repos[repo]; !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	f, err := s.fsys.Open(blobPath(h))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob not found")
+			return
+		}
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	defer f.Close() // nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Docker-Content-Digest", h.String())
+	if r.Method == http.MethodGet {
+		if _, err := io.Copy(w, f); err != nil {
+			klog.Errorf("failed to send blob %s: %v", h, err)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+// registryError writes an error in the format of the distribution spec.
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
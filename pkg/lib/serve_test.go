@@ -0,0 +1,67 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestManifestMediaType(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want types.MediaType
+	}{
+		{
+			name: "docker manifest list",
+			raw:  `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[]}`,
+			want: types.DockerManifestList,
+		},
+		{
+			name: "docker manifest",
+			raw:  `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{},"layers":[]}`,
+			want: types.DockerManifestSchema2,
+		},
+		{
+			name: "oci index without media type",
+			raw:  `{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json"}]}`,
+			want: types.OCIImageIndex,
+		},
+		{
+			name: "oci manifest without media type",
+			raw:  `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"},"layers":[{}]}`,
+			want: types.OCIManifestSchema1,
+		},
+		{
+			name: "oci artifact without layers",
+			raw:  `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.empty.v1+json"}}`,
+			want: types.OCIManifestSchema1,
+		},
+		{name: "schema 1", raw: `{"schemaVersion":1,"fsLayers":[]}`},
+		{name: "not a manifest", raw: `{"schemaVersion":2}`},
+		{name: "layer", raw: "\x1f\x8b\x08\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manifestMediaType([]byte(tt.raw)); got != tt.want {
+				t.Errorf("media type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
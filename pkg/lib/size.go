@@ -0,0 +1,189 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// SizeReport is the compressed size of a set of images as it would be
+// exported, computed from the manifests only.
+type SizeReport struct {
+	Images []ImageSize
+	// Total counts every blob once, however many images share it.
+	Total int64
+	Blobs int
+}
+
+type ImageSize struct {
+	Ref    string
+	Digest string
+	// Size counts every blob of the image once, across all its platforms.
+	Size int64
+	// Unique is the part of Size not shared with any other image of the report.
+	Unique    int64
+	Platforms []PlatformSize
+}
+
+type PlatformSize struct {
+	Platform string
+	Digest   string
+	Size     int64
+}
+
+// EstimateSize reads the manifests of images and sums up the compressed size
+// of their manifests, configs and layers. Non-distributable layers are only
+// counted with opts.Nondistro, as they are not exported otherwise.
+func EstimateSize(images []string, opts BundleOptions) (*SizeReport, error) {
+	var report SizeReport
+	sizes := map[string]int64{}
+	owners := map[string]int{}
+	imageBlobs := make([]map[string]int64, 0, len(images))
+
+	for _, img := range images {
+		ref, err := name.ParseReference(img, opts.nameOptions()...)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := remote.Get(ref, opts.remoteOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", img, err)
+		}
+
+		is := ImageSize{
+			Ref:    img,
+			Digest: desc.Digest.String(),
+		}
+		blobs := map[string]int64{}
+		if desc.MediaType.IsIndex() {
+			idx, err := desc.ImageIndex()
+			if err != nil {
+				return nil, err
+			}
+			if err := indexSizes(idx, opts.Nondistro, &is, blobs); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", img, err)
+			}
+		} else {
+			image, err := desc.Image()
+			if err != nil {
+				return nil, err
+			}
+			ps, err := imageSize(image, opts.Nondistro, blobs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", img, err)
+			}
+			ps.Platform = "unknown"
+			if cfg, err := image.ConfigFile(); err == nil && cfg.Platform() != nil {
+				ps.Platform = cfg.Platform().String()
+			}
+			is.Platforms = append(is.Platforms, *ps)
+		}
+		blobs[desc.Digest.String()] = desc.Size
+
+		for d, size := range blobs {
+			is.Size += size
+			sizes[d] = size
+			owners[d]++
+		}
+		report.Images = append(report.Images, is)
+		imageBlobs = append(imageBlobs, blobs)
+	}
+
+	for i, blobs := range imageBlobs {
+		for d, size := range blobs {
+			if owners[d] == 1 {
+				report.Images[i].Unique += size
+			}
+		}
+	}
+	for _, size := range sizes {
+		report.Total += size
+	}
+	report.Blobs = len(sizes)
+	return &report, nil
+}
+
+func indexSizes(idx v1.ImageIndex, nondistro bool, is *ImageSize, blobs map[string]int64) error {
+	mf, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range mf.Manifests {
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := indexSizes(child, nondistro, is, blobs); err != nil {
+				return err
+			}
+			blobs[desc.Digest.String()] = desc.Size
+			continue
+		}
+
+		image, err := idx.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		ps, err := imageSize(image, nondistro, blobs)
+		if err != nil {
+			return err
+		}
+		ps.Platform = "unknown"
+		if desc.Platform != nil {
+			ps.Platform = desc.Platform.String()
+		}
+		is.Platforms = append(is.Platforms, *ps)
+	}
+	return nil
+}
+
+// imageSize adds the blobs of image to blobs and returns the size of the image
+// on its own.
+func imageSize(image v1.Image, nondistro bool, blobs map[string]int64) (*PlatformSize, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := image.Size()
+	if err != nil {
+		return nil, err
+	}
+	mf, err := image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	ps := PlatformSize{
+		Digest: digest.String(),
+		Size:   size + mf.Config.Size,
+	}
+	blobs[digest.String()] = size
+	blobs[mf.Config.Digest.String()] = mf.Config.Size
+	for _, l := range mf.Layers {
+		if !nondistro && !l.MediaType.IsDistributable() {
+			continue
+		}
+		ps.Size += l.Size
+		blobs[l.Digest.String()] = l.Size
+	}
+	return &ps, nil
+}
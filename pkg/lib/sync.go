@@ -0,0 +1,124 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"k8s.io/klog/v2"
+)
+
+type SyncStatus string
+
+const (
+	SyncCopied  SyncStatus = "copied"
+	SyncSkipped SyncStatus = "skipped"
+	SyncFailed  SyncStatus = "failed"
+)
+
+type SyncResult struct {
+	Source string
+	Target string
+	Digest string
+	Status SyncStatus
+	Err    error
+}
+
+// SyncImages copies every image to its target in the mirror registry unless
+// the target already has the source digest. A failed image does not stop the
+// sync; its error is recorded in the result.
+//
+// Layers of remote images are mountable, so when the source and the target
+// share a registry, blobs are mounted across repositories instead of being
+// pulled and pushed again.
+func SyncImages(images []string, rw *Rewriter, opts BundleOptions) []SyncResult {
+	results := make([]SyncResult, 0, len(images))
+	for _, img := range images {
+		r := SyncResult{Source: img}
+		if err := syncImage(img, rw, opts, &r); err != nil {
+			r.Status = SyncFailed
+			r.Err = err
+			klog.Errorf("failed to sync %s: %v", img, err)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func syncImage(img string, rw *Rewriter, opts BundleOptions, r *SyncResult) error {
+	target, err := rw.Target(img)
+	if err != nil {
+		return err
+	}
+	r.Target = target
+
+	src, err := name.ParseReference(img, opts.nameOptions()...)
+	if err != nil {
+		return err
+	}
+	dst, err := name.ParseReference(target, opts.nameOptions()...)
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Get(src, opts.remoteOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", img, err)
+	}
+	r.Digest = desc.Digest.String()
+
+	existing, err := remote.Head(dst, opts.remoteOptions()...)
+	if err != nil && !ImageNotFound(err) {
+		return err
+	}
+	if err == nil && existing.Digest == desc.Digest {
+		klog.Infof("skipping %s, %s is up to date", img, target)
+		r.Status = SyncSkipped
+		return nil
+	}
+
+	klog.Infof("copying %s to %s", img, target)
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		if err := remote.WriteIndex(dst, idx, opts.remoteOptions()...); err != nil {
+			return err
+		}
+	} else {
+		image, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if err := remote.Write(dst, image, opts.remoteOptions()...); err != nil {
+			return err
+		}
+	}
+
+	pushed, err := remote.Head(dst, opts.remoteOptions()...)
+	if err != nil {
+		return err
+	}
+	if pushed.Digest != desc.Digest {
+		return fmt.Errorf("digest mismatch: pushed %s, expected %s", pushed.Digest, desc.Digest)
+	}
+	r.Status = SyncCopied
+	return nil
+}
@@ -65,8 +65,8 @@ func SummarizeReport(report *trivy.SingleReport) map[string]int {
 	return riskOccurrence
 }
 
-func ImageDigest(ref string) (string, bool, error) {
-	digest, err := crane.Digest(ref, crane.WithAuthFromKeychain(authn.DefaultKeychain))
+func ImageDigest(ref string, opts ...crane.Option) (string, bool, error) {
+	digest, err := crane.Digest(ref, append([]crane.Option{crane.WithAuthFromKeychain(authn.DefaultKeychain)}, opts...)...)
 	if err != nil {
 		if ImageNotFound(err) {
 			return "", false, nil
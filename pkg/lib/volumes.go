@@ -0,0 +1,386 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	VolumeIndexFile = "volumes.json"
+
+	tarBlockSize = 512
+)
+
+// VolumeIndex describes how the files of a bundle are spread over a set of
+// tar volumes. Each volume is a regular tar archive; the index records where
+// the content of every file starts inside the volumes, so that a bundle can
+// be read without extracting the volumes first.
+type VolumeIndex struct {
+	Version string       `json:"version"`
+	Volumes []Volume     `json:"volumes"`
+	Files   []VolumeFile `json:"files"`
+}
+
+type Volume struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type VolumeFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Parts lists the pieces of the file in order. Only blobs larger than a
+	// volume are split into more than one part.
+	Parts []VolumePart `json:"parts"`
+}
+
+type VolumePart struct {
+	Volume int   `json:"volume"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+type volumeEntry struct {
+	file *VolumeFile
+	name string
+	// part is the index of this entry in file.Parts, offset its position in the file.
+	part   int
+	offset int64
+	size   int64
+}
+
+type volumePlan struct {
+	used    int64
+	entries []volumeEntry
+}
+
+// SplitBundle packs the bundle in dir into tar volumes of at most maxSize
+// bytes in outDir and writes the volume index next to them. Blobs are kept
+// whole unless they do not fit into a single volume.
+func SplitBundle(dir, outDir string, maxSize int64) (*VolumeIndex, error) {
+	// every tar ends with two zero blocks
+	capacity := maxSize - 2*tarBlockSize
+	if capacity < 2*tarBlockSize {
+		return nil, fmt.Errorf("volume size %d is too small", maxSize)
+	}
+
+	var meta, blobs []*VolumeFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := &VolumeFile{Path: filepath.ToSlash(rel), Size: fi.Size()}
+		if strings.HasPrefix(f.Path, "blobs/") {
+			blobs = append(blobs, f)
+		} else {
+			meta = append(meta, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// largest first packs the volumes tighter
+	sort.SliceStable(blobs, func(i, j int) bool { return blobs[i].Size > blobs[j].Size })
+	files := append(meta, blobs...)
+
+	var plans []*volumePlan
+	place := func(e volumeEntry) {
+		cost := tarEntrySize(e.size)
+		for _, p := range plans {
+			if p.used+cost <= capacity {
+				p.used += cost
+				p.entries = append(p.entries, e)
+				return
+			}
+		}
+		plans = append(plans, &volumePlan{used: cost, entries: []volumeEntry{e}})
+	}
+
+	chunk := (capacity - tarBlockSize) / tarBlockSize * tarBlockSize
+	for _, f := range files {
+		if tarEntrySize(f.Size) <= capacity {
+			f.Parts = make([]VolumePart, 1)
+			place(volumeEntry{file: f, name: f.Path, size: f.Size})
+			continue
+		}
+		f.Parts = make([]VolumePart, (f.Size+chunk-1)/chunk)
+		for i := range f.Parts {
+			off := int64(i) * chunk
+			place(volumeEntry{
+				file:   f,
+				name:   fmt.Sprintf("%s.part%03d", f.Path, i),
+				part:   i,
+				offset: off,
+				size:   min(chunk, f.Size-off),
+			})
+		}
+	}
+
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+	index := VolumeIndex{
+		Version: BundleFormatVersion,
+		Volumes: make([]Volume, 0, len(plans)),
+		Files:   make([]VolumeFile, 0, len(files)),
+	}
+	for i, p := range plans {
+		v, err := writeVolume(dir, filepath.Join(outDir, fmt.Sprintf("bundle-%03d.tar", i+1)), i, p)
+		if err != nil {
+			return nil, err
+		}
+		index.Volumes = append(index.Volumes, *v)
+	}
+	for _, f := range files {
+		index.Files = append(index.Files, *f)
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, VolumeIndexFile), data, 0o644); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func tarEntrySize(size int64) int64 {
+	return tarBlockSize + (size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeVolume writes the entries of p into the tar file filename and records
+// the position of their content in the parts of their files.
+func writeVolume(dir, filename string, volume int, p *volumePlan) (*Volume, error) {
+	out, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close() // nolint:errcheck
+
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(out, h)}
+	tw := tar.NewWriter(cw)
+	for _, e := range p.entries {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Size:     e.size,
+			Mode:     0o644,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatUSTAR,
+		})
+		if err != nil {
+			return nil, err
+		}
+		e.file.Parts[e.part] = VolumePart{Volume: volume, Offset: cw.n, Size: e.size}
+
+		if err := copyFileRange(tw, filepath.Join(dir, filepath.FromSlash(e.file.Path)), e.offset, e.size); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	return &Volume{
+		Name:   filepath.Base(filename),
+		Size:   cw.n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func copyFileRange(w io.Writer, filename string, offset, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	_, err = io.Copy(w, io.NewSectionReader(f, offset, size))
+	return err
+}
+
+// OpenVolumes returns the bundle stored in the volumes in dir. Files are read
+// from the volumes in place. The size and checksum of every volume is checked
+// against the index first, so that a corrupt, truncated or swapped volume is
+// reported by name before anything is read from it.
+func OpenVolumes(dir string) (fs.FS, error) {
+	data, err := os.ReadFile(filepath.Join(dir, VolumeIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index VolumeIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	if index.Version != BundleFormatVersion {
+		return nil, fmt.Errorf("unsupported volume index version %q", index.Version)
+	}
+
+	for _, vol := range index.Volumes {
+		if err := verifyVolume(dir, vol); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &volumeFS{
+		dir:     dir,
+		volumes: index.Volumes,
+		files:   make(map[string]VolumeFile, len(index.Files)),
+	}
+	for _, f := range index.Files {
+		for _, p := range f.Parts {
+			if p.Volume < 0 || p.Volume >= len(index.Volumes) {
+				return nil, fmt.Errorf("%s refers to unknown volume %d", f.Path, p.Volume)
+			}
+		}
+		v.files[f.Path] = f
+	}
+	return v, nil
+}
+
+func verifyVolume(dir string, vol Volume) error {
+	if vol.Name != filepath.Base(vol.Name) {
+		return fmt.Errorf("invalid volume name %q", vol.Name)
+	}
+	f, err := os.Open(filepath.Join(dir, vol.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != vol.Size {
+		return fmt.Errorf("volume %s: size %d does not match %d in %s", vol.Name, fi.Size(), vol.Size, VolumeIndexFile)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("volume %s: %w", vol.Name, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != vol.SHA256 {
+		return fmt.Errorf("volume %s: checksum %s does not match %s in %s", vol.Name, sum, vol.SHA256, VolumeIndexFile)
+	}
+	return nil
+}
+
+type volumeFS struct {
+	dir     string
+	volumes []Volume
+	files   map[string]VolumeFile
+}
+
+var _ fs.FS = (*volumeFS)(nil)
+
+func (v *volumeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, ok := v.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	vf := &volumeFile{info: volumeFileInfo{name: path.Base(name), size: f.Size}}
+	readers := make([]io.Reader, 0, len(f.Parts))
+	for _, p := range f.Parts {
+		file, err := os.Open(filepath.Join(v.dir, v.volumes[p.Volume].Name))
+		if err != nil {
+			_ = vf.Close()
+			return nil, err
+		}
+		vf.closers = append(vf.closers, file)
+		readers = append(readers, io.NewSectionReader(file, p.Offset, p.Size))
+	}
+	vf.r = io.MultiReader(readers...)
+	return vf, nil
+}
+
+type volumeFile struct {
+	info    volumeFileInfo
+	r       io.Reader
+	closers []io.Closer
+}
+
+func (f *volumeFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *volumeFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *volumeFile) Close() error {
+	var errs []error
+	for _, c := range f.closers {
+		errs = append(errs, c.Close())
+	}
+	f.closers = nil
+	return errors.Join(errs...)
+}
+
+type volumeFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi volumeFileInfo) Name() string       { return fi.name }
+func (fi volumeFileInfo) Size() int64        { return fi.size }
+func (fi volumeFileInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi volumeFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi volumeFileInfo) IsDir() bool        { return false }
+func (fi volumeFileInfo) Sys() any           { return nil }
@@ -0,0 +1,182 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestBundle(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSplitBundle(t *testing.T) {
+	files := map[string][]byte{
+		"manifest.json":          []byte(`{"version":"v1"}`),
+		"index.json":             []byte(`{}`),
+		"blobs/sha256/small":     bytes.Repeat([]byte{'s'}, 100),
+		"blobs/sha256/medium":    bytes.Repeat([]byte{'m'}, 3000),
+		"blobs/sha256/large":     bytes.Repeat([]byte{'l'}, 10000),
+		"blobs/sha256/one-block": bytes.Repeat([]byte{'b'}, tarBlockSize),
+	}
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		wantSplit []string
+	}{
+		{name: "everything fits into one volume", maxSize: 1 << 20},
+		{name: "large blobs are split", maxSize: 8192, wantSplit: []string{"blobs/sha256/large"}},
+		{name: "small volumes", maxSize: 2048, wantSplit: []string{"blobs/sha256/large", "blobs/sha256/medium"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outDir := t.TempDir()
+			index, err := SplitBundle(writeTestBundle(t, files), outDir, tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range index.Volumes {
+				if v.Size > tt.maxSize {
+					t.Errorf("volume %s has %d bytes, more than %d", v.Name, v.Size, tt.maxSize)
+				}
+			}
+			var split []string
+			for _, f := range index.Files {
+				if len(f.Parts) > 1 {
+					split = append(split, f.Path)
+				}
+			}
+			if strings.Join(split, ",") != strings.Join(tt.wantSplit, ",") {
+				t.Errorf("split files = %v, want %v", split, tt.wantSplit)
+			}
+
+			fsys, err := OpenVolumes(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range files {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: content differs after split", name)
+				}
+			}
+			if _, err := fsys.Open("blobs/sha256/missing"); err == nil {
+				t.Error("expected an error for a file not in the bundle")
+			}
+		})
+	}
+}
+
+func TestSplitBundleTooSmall(t *testing.T) {
+	dir := writeTestBundle(t, map[string][]byte{"manifest.json": []byte(`{}`)})
+	if _, err := SplitBundle(dir, t.TempDir(), 3*tarBlockSize); err == nil {
+		t.Fatal("expected an error for a volume size below four tar blocks")
+	}
+}
+
+func TestOpenVolumesVerifiesChecksums(t *testing.T) {
+	files := map[string][]byte{
+		"manifest.json":  []byte(`{}`),
+		"blobs/sha256/a": bytes.Repeat([]byte{'a'}, 3000),
+		"blobs/sha256/b": bytes.Repeat([]byte{'b'}, 3000),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, dir string, index *VolumeIndex)
+	}{
+		{
+			name: "corrupt volume",
+			modify: func(t *testing.T, dir string, index *VolumeIndex) {
+				p := filepath.Join(dir, index.Volumes[0].Name)
+				data, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data[len(data)/2] ^= 0xff
+				if err := os.WriteFile(p, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "truncated volume",
+			modify: func(t *testing.T, dir string, index *VolumeIndex) {
+				if err := os.Truncate(filepath.Join(dir, index.Volumes[0].Name), 1024); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "swapped volumes",
+			modify: func(t *testing.T, dir string, index *VolumeIndex) {
+				a := filepath.Join(dir, index.Volumes[0].Name)
+				b := filepath.Join(dir, index.Volumes[1].Name)
+				tmp := filepath.Join(dir, "tmp")
+				for _, mv := range [][2]string{{a, tmp}, {b, a}, {tmp, b}} {
+					if err := os.Rename(mv[0], mv[1]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+		},
+		{
+			name: "missing volume",
+			modify: func(t *testing.T, dir string, index *VolumeIndex) {
+				if err := os.Remove(filepath.Join(dir, index.Volumes[1].Name)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outDir := t.TempDir()
+			index, err := SplitBundle(writeTestBundle(t, files), outDir, 4096)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Volumes) < 2 {
+				t.Fatalf("expected at least two volumes, got %d", len(index.Volumes))
+			}
+			tt.modify(t, outDir, index)
+			if _, err := OpenVolumes(outDir); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
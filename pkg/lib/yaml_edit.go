@@ -0,0 +1,150 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ScalarEdit replaces the value of a scalar node decoded from a YAML source.
+type ScalarEdit struct {
+	Node  *yaml.Node
+	Value string
+}
+
+type scalarSpan struct {
+	start, end int
+	value      string
+}
+
+// ApplyScalarEdits replaces the scalars of edits in data, the source their
+// nodes were decoded from, and leaves every other byte as it is, so that
+// comments, key order, indentation and quoting are kept. Plain, single and
+// double quoted scalars keep their style and quoted values are escaped; block
+// scalars are not supported. Plain values are written as they are, so they
+// must be valid plain scalars, like image references are.
+func ApplyScalarEdits(data []byte, edits []ScalarEdit) ([]byte, error) {
+	lines := lineOffsets(data)
+
+	spans := make([]scalarSpan, 0, len(edits))
+	for _, e := range edits {
+		s, err := locateScalar(data, lines, e.Node)
+		if err != nil {
+			return nil, err
+		}
+		switch scalarStyle(e.Node) {
+		case yaml.DoubleQuotedStyle:
+			s.value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(e.Value) + `"`
+		case yaml.SingleQuotedStyle:
+			s.value = "'" + strings.ReplaceAll(e.Value, "'", "''") + "'"
+		default:
+			s.value = e.Value
+		}
+		spans = append(spans, *s)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			return nil, fmt.Errorf("overlapping edits at offset %d", s.start)
+		}
+		buf.Write(data[last:s.start])
+		buf.WriteString(s.value)
+		last = s.end
+	}
+	buf.Write(data[last:])
+	return buf.Bytes(), nil
+}
+
+// scalarStyle returns the quoting style of n, an explicit tag does not change it.
+func scalarStyle(n *yaml.Node) yaml.Style {
+	return n.Style &^ yaml.TaggedStyle
+}
+
+func lineOffsets(data []byte) []int {
+	offsets := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+// locateScalar finds the bytes of the scalar n in data. An anchor or tag in
+// front of the value is skipped.
+func locateScalar(data []byte, lines []int, n *yaml.Node) (*scalarSpan, error) {
+	if n.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("line %d: not a scalar", n.Line)
+	}
+	if n.Line < 1 || n.Line > len(lines) {
+		return nil, fmt.Errorf("line %d: out of range", n.Line)
+	}
+	off := lines[n.Line-1]
+	// columns count characters, not bytes
+	for col := 1; col < n.Column && off < len(data) && data[off] != '\n'; col++ {
+		_, size := utf8.DecodeRune(data[off:])
+		off += size
+	}
+	for off < len(data) && (data[off] == '&' || data[off] == '!') {
+		for off < len(data) && data[off] != ' ' && data[off] != '\t' && data[off] != '\n' {
+			off++
+		}
+		for off < len(data) && (data[off] == ' ' || data[off] == '\t') {
+			off++
+		}
+	}
+
+	switch style := scalarStyle(n); style {
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		quote := byte('"')
+		if style == yaml.SingleQuotedStyle {
+			quote = '\''
+		}
+		if off >= len(data) || data[off] != quote {
+			return nil, fmt.Errorf("line %d: quoted value %q not found", n.Line, n.Value)
+		}
+		start := off
+		for i := start + 1; i < len(data); i++ {
+			switch {
+			case quote == '"' && data[i] == '\\':
+				i++
+			case data[i] == quote && quote == '\'' && i+1 < len(data) && data[i+1] == '\'':
+				i++
+			case data[i] == quote:
+				return &scalarSpan{start: start, end: i + 1}, nil
+			}
+		}
+		return nil, fmt.Errorf("line %d: unterminated quoted value %q", n.Line, n.Value)
+	case 0:
+		if n.Value == "" || !bytes.HasPrefix(data[off:], []byte(n.Value)) {
+			return nil, fmt.Errorf("line %d: value %q not found, multi-line plain values are not supported", n.Line, n.Value)
+		}
+		return &scalarSpan{start: off, end: off + len(n.Value)}, nil
+	default:
+		return nil, fmt.Errorf("line %d: block scalar values are not supported", n.Line)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// editImages replaces every value of an "image" key in the documents of data
+// with the result of fn.
+func editImages(data []byte, fn func(string) string) ([]byte, error) {
+	var edits []ScalarEdit
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == "image" && n.Content[i+1].Kind == yaml.ScalarNode {
+					edits = append(edits, ScalarEdit{Node: n.Content[i+1], Value: fn(n.Content[i+1].Value)})
+					continue
+				}
+				walk(n.Content[i+1])
+			}
+			return
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		walk(&doc)
+	}
+	return ApplyScalarEdits(data, edits)
+}
+
+func TestApplyScalarEdits(t *testing.T) {
+	pin := func(img string) string { return img + "@sha256:abc" }
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "plain",
+			in:   "spec:\n  image: nginx:1.25 # pinned later\n  name: web\n",
+			want: "spec:\n  image: nginx:1.25@sha256:abc # pinned later\n  name: web\n",
+		},
+		{
+			name: "double quoted",
+			in:   "image: \"nginx:1.25\"\n",
+			want: "image: \"nginx:1.25@sha256:abc\"\n",
+		},
+		{
+			name: "single quoted",
+			in:   "image: 'nginx:1.25'\n",
+			want: "image: 'nginx:1.25@sha256:abc'\n",
+		},
+		{
+			name: "flow mapping",
+			in:   "containers: [{name: a, image: nginx:1.25}, {image: redis:7, name: b}]\n",
+			want: "containers: [{name: a, image: nginx:1.25@sha256:abc}, {image: redis:7@sha256:abc, name: b}]\n",
+		},
+		{
+			name: "several values on one line",
+			in:   "a: {image: x:1}\nb: {image: 'y:2', c: {image: \"z:3\"}}\n",
+			want: "a: {image: x:1@sha256:abc}\nb: {image: 'y:2@sha256:abc', c: {image: \"z:3@sha256:abc\"}}\n",
+		},
+		{
+			name: "multi-byte characters before the value",
+			in:   "labels: {café: ☕}\nspec: {désc: ü, image: nginx:1.25}\n",
+			want: "labels: {café: ☕}\nspec: {désc: ü, image: nginx:1.25@sha256:abc}\n",
+		},
+		{
+			name: "anchor and tag",
+			in:   "a:\n  image: &img !!str nginx:1.25\nb:\n  ref: *img\n",
+			want: "a:\n  image: &img !!str nginx:1.25@sha256:abc\nb:\n  ref: *img\n",
+		},
+		{
+			name: "documents are edited in place",
+			in: "# first\nimage: a:1\n---\n# second, with CRLF-free comment\nkind: ConfigMap\ndata:\n  x: |\n    image: not-a-key:1\n" +
+				"---\nspec:\n  containers:\n    - image:   \"b:2\"   # spaces\n",
+			want: "# first\nimage: a:1@sha256:abc\n---\n# second, with CRLF-free comment\nkind: ConfigMap\ndata:\n  x: |\n    image: not-a-key:1\n" +
+				"---\nspec:\n  containers:\n    - image:   \"b:2@sha256:abc\"   # spaces\n",
+		},
+		{
+			name: "escaped quotes",
+			in:   "image: \"na\\\"me:1\"\nother: x\n",
+			want: "image: \"na\\\"me:1@sha256:abc\"\nother: x\n",
+		},
+		{
+			name: "single quotes are escaped",
+			in:   "image: 'it''s:1'\n",
+			want: "image: 'it''s:1@sha256:abc'\n",
+		},
+		{
+			name:    "block scalars are not supported",
+			in:      "image: |\n  nginx:1.25\n",
+			wantErr: true,
+		},
+		{
+			name:    "multi-line plain scalars are not supported",
+			in:      "image: nginx\n  :1.25\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editImages([]byte(tt.in), pin)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyScalarEditsOverlap(t *testing.T) {
+	var doc yaml.Node
+	data := []byte("image: nginx:1.25\n")
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	n := doc.Content[0].Content[1]
+	if _, err := ApplyScalarEdits(data, []ScalarEdit{{Node: n, Value: "a"}, {Node: n, Value: "b"}}); err == nil {
+		t.Fatal("expected an error for overlapping edits")
+	}
+}
+
+func TestApplyScalarEditsNotScalar(t *testing.T) {
+	var doc yaml.Node
+	data := []byte("image: {name: nginx}\n")
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ApplyScalarEdits(data, []ScalarEdit{{Node: doc.Content[0].Content[1], Value: "x"}}); err == nil {
+		t.Fatal("expected an error for a mapping")
+	}
+}
@@ -33,6 +33,6 @@ mv /tmp/crane images
 
 CMD="./images/crane"
 
-$CMD pull ghcr.io/appscode/cluster-ui:0.9.7 images/appscode-cluster-ui-0.9.7.tar
+$CMD pull ghcr.io/appscode/cluster-ui:0.9.7 images/ghcr.io+appscode+cluster-ui=0.9.7.tar
 
 tar -czvf images.tar.gz images
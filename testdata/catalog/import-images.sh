@@ -28,4 +28,4 @@ tar -zxvf $TARBALL
 
 CMD="./crane"
 
-$CMD push images/appscode-cluster-ui-0.9.7.tar $IMAGE_REGISTRY/appscode/cluster-ui:0.9.7
+$CMD push images/ghcr.io+appscode+cluster-ui=0.9.7.tar $IMAGE_REGISTRY/appscode/cluster-ui:0.9.7